@@ -0,0 +1,149 @@
+package rabbitmqpool
+
+import (
+	"context"
+)
+
+/*
+异步发送结果
+*/
+type PushFuture struct {
+	data     *RabbitMqData
+	done     chan struct{}
+	err      *RabbitMqError
+	callback func(data *RabbitMqData, err *RabbitMqError)
+}
+
+func newPushFuture(data *RabbitMqData, callback func(data *RabbitMqData, err *RabbitMqError)) *PushFuture {
+	return &PushFuture{data: data, done: make(chan struct{}), callback: callback}
+}
+
+func (f *PushFuture) complete(err *RabbitMqError) {
+	f.err = err
+	close(f.done)
+	if f.callback != nil {
+		f.callback(f.data, err)
+	}
+}
+
+/*
+发送完成后关闭
+*/
+func (f *PushFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+/*
+等待发送完成,返回发送结果
+*/
+func (f *PushFuture) Wait() *RabbitMqError {
+	<-f.done
+	return f.err
+}
+
+/*
+发送结果,未完成时返回nil
+*/
+func (f *PushFuture) Err() *RabbitMqError {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+/*
+异步发送
+消息放入发送队列后立即返回,由后台协程通过Push发送(包括重试和写入存储)
+队列已满时等待,ctx只控制入队等待,取消或超时时返回RCODE_ASYNC_QUEUE_ERROR
+*/
+func (r *RabbitPool) PushAsync(ctx context.Context, data *RabbitMqData) *PushFuture {
+	f := newPushFuture(data, nil)
+	r.enqueueAsync(ctx, f)
+	return f
+}
+
+/*
+异步发送,完成后在发送协程中回调callback
+*/
+func (r *RabbitPool) PushAsyncCallback(ctx context.Context, data *RabbitMqData, callback func(data *RabbitMqData, err *RabbitMqError)) {
+	r.enqueueAsync(ctx, newPushFuture(data, callback))
+}
+
+func (r *RabbitPool) enqueueAsync(ctx context.Context, f *PushFuture) {
+	r.asyncOnce.Do(r.startAsync)
+	r.asyncLock.RLock()
+	defer r.asyncLock.RUnlock()
+	if r.asyncClosed {
+		f.complete(NewRabbitMqError(RCODE_ASYNC_QUEUE_ERROR, "连接池已关闭", ""))
+		return
+	}
+	select {
+	case r.asyncQueue <- f:
+	case <-r.closeChan:
+		f.complete(NewRabbitMqError(RCODE_ASYNC_QUEUE_ERROR, "连接池已关闭", ""))
+	case <-ctx.Done():
+		f.complete(NewRabbitMqError(RCODE_ASYNC_QUEUE_ERROR, "发送队列已满", ctx.Err().Error()))
+	}
+}
+
+func (r *RabbitPool) startAsync() {
+	r.asyncQueue = make(chan *PushFuture, r.asyncQueueSize)
+	for i := 0; i < r.asyncWorkers; i++ {
+		r.asyncWait.Add(1)
+		go r.asyncWorker()
+	}
+}
+
+func (r *RabbitPool) asyncWorker() {
+	defer r.asyncWait.Done()
+	for {
+		//关闭后不再取出新消息,由stopAsync写入存储
+		select {
+		case <-r.closeChan:
+			return
+		default:
+		}
+		select {
+		case <-r.closeChan:
+			return
+		case f := <-r.asyncQueue:
+			f.complete(r.Push(f.data))
+		}
+	}
+}
+
+/*
+关闭异步发送,Close时在关闭存储之前调用
+等待正在入队的调用返回、发送协程发送完当前消息后,队列中未发送的消息写入存储,
+写入成功时结果为nil,未配置存储时返回RCODE_ASYNC_QUEUE_ERROR;回调在Close的协程中执行
+*/
+func (r *RabbitPool) stopAsync() {
+	r.asyncLock.Lock()
+	r.asyncClosed = true
+	r.asyncLock.Unlock()
+	r.asyncOnce.Do(func() {})
+	if r.asyncQueue == nil {
+		return
+	}
+	r.asyncWait.Wait()
+	for {
+		select {
+		case f := <-r.asyncQueue:
+			f.complete(r.spoolUnsent(f.data))
+		default:
+			return
+		}
+	}
+}
+
+/*
+连接池关闭时异步队列中未发送的消息写入存储
+*/
+func (r *RabbitPool) spoolUnsent(data *RabbitMqData) *RabbitMqError {
+	if store, err := r.getFailoverStore(data); err == nil && store == nil {
+		return NewRabbitMqError(RCODE_ASYNC_QUEUE_ERROR, "连接池已关闭,未配置存储,消息未发送", "")
+	}
+	return spoolResult("连接池已关闭,消息未发送", r.spoolData(data, "连接池关闭时异步队列未发送", 0))
+}
@@ -0,0 +1,99 @@
+package rabbitmqpool
+
+import (
+	"context"
+	"errors"
+)
+
+/*
+批量发送消息
+
+整批只获取一次连接和锁,声明每条消息的交换机/队列/路由后在同一信道上连续发送,
+连接池开启发布确认或批次中有mandatory消息时,全部发送后统一等待broker确认,
+设置了限流时每条消息发送前按限流规则等待或拒绝
+
+返回与batch一一对应的结果,成功为nil;失败的消息不重试也不写入存储,由调用方处理
+*/
+func (r *RabbitPool) PushBatch(ctx context.Context, batch []*RabbitMqData) []*RabbitMqError {
+	results := make([]*RabbitMqError, len(batch))
+	if len(batch) == 0 {
+		return results
+	}
+	rc, err := r.batchChannel(batch, results)
+	if err != nil {
+		code, message := RCODE_GET_CHANNEL_ERROR, "获取信道失败"
+		if errors.Is(err, ErrConnectionDown) {
+			code, message = RCODE_CONNECTION_ERROR, "连接失败"
+		}
+		for i := range results {
+			if results[i] == nil {
+				results[i] = NewRabbitMqError(code, message, err.Error())
+			}
+		}
+		return results
+	}
+
+	pending := make([]*pendingPublish, len(batch))
+	for i, data := range batch {
+		if results[i] != nil {
+			continue
+		}
+		if results[i] = r.limit(ctx, data); results[i] != nil {
+			continue
+		}
+		if pending[i], err = r.send(ctx, rc, data); err != nil {
+			results[i] = NewRabbitMqError(RCODE_PUSH_ERROR, "消息推送失败", err.Error())
+		}
+	}
+	for i, p := range pending {
+		if p == nil {
+			continue
+		}
+		err = r.settle(ctx, rc, p)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrPublishReturned):
+			results[i] = r.pushReturned(batch[i], err)
+		default:
+			results[i] = NewRabbitMqError(RCODE_PUSH_ERROR, "消息推送失败", err.Error())
+		}
+	}
+	return results
+}
+
+/*
+声明批次中的所有交换机/队列/路由,返回发送使用的信道
+声明失败的消息在results中记录错误
+*/
+func (r *RabbitPool) batchChannel(batch []*RabbitMqData, results []*RabbitMqError) (*rChannel, error) {
+	r.channelLock.Lock()
+	defer r.channelLock.Unlock()
+	first := batch[0]
+	conn := r.getConnection()
+	conn, isTry, err := tryConn(r, conn, first.ExchangeName, first.ExchangeType, first.QueueName, first.Route)
+	if err != nil {
+		return nil, err
+	}
+	//mandatory消息需等待ack才能确定是否被退回,整批使用confirm信道
+	mandatory := false
+	for _, data := range batch {
+		mandatory = mandatory || data.Mandatory
+	}
+	var rc *rChannel
+	var lastErr error
+	for i, data := range batch {
+		c, err := r.getPublishChannel(conn, data, mandatory, isTry)
+		if err != nil {
+			results[i] = NewRabbitMqError(RCODE_CHANNEL_QUEUE_EXCHANGE_BIND_ERROR, "交换机/队列/绑定失败", err.Error())
+			lastErr = err
+			continue
+		}
+		if rc == nil {
+			rc = c
+		}
+	}
+	if rc == nil {
+		return nil, lastErr
+	}
+	return rc, nil
+}
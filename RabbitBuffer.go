@@ -0,0 +1,166 @@
+package rabbitmqpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+断线缓冲区已满时的处理策略
+*/
+const (
+	BUFFER_BLOCK = 1 //阻塞调用方直到缓冲区有空间,PushWithContext时受ctx控制
+	BUFFER_DROP  = 2 //丢弃新消息
+	BUFFER_SPOOL = 3 //写入存储,连接恢复后由存储重发
+)
+
+const (
+	DEFAULT_BUFFER_DRAIN_INTERVAL = time.Second //检查连接恢复并发送缓冲区消息的间隔
+)
+
+/*
+连接断开时是否放入缓冲区
+*/
+func (r *RabbitPool) shouldBuffer(data *RabbitMqData) bool {
+	return r.buffer != nil && !data.replay && !r.IsHealthy()
+}
+
+/*
+连接断开时消息放入缓冲区,连接恢复后按顺序发送
+放入缓冲区或写入存储成功时返回nil
+*/
+func (r *RabbitPool) bufferPush(ctx context.Context, data *RabbitMqData) *RabbitMqError {
+	r.bufferLock.RLock()
+	defer r.bufferLock.RUnlock()
+	if r.bufferClosed {
+		return r.bufferOverflow(data, errors.New("连接池已关闭"))
+	}
+	select {
+	case r.buffer <- data:
+		return nil
+	default:
+	}
+	if r.bufferPolicy != BUFFER_BLOCK {
+		return r.bufferOverflow(data, errors.New("连接断开且缓冲区已满"))
+	}
+	select {
+	case r.buffer <- data:
+		return nil
+	case <-ctx.Done():
+		return NewRabbitMqError(RCODE_BUFFER_FULL_ERROR, "连接断开且缓冲区已满", ctx.Err().Error())
+	case <-r.closeChan:
+		return NewRabbitMqError(RCODE_BUFFER_FULL_ERROR, "连接池已关闭", "")
+	}
+}
+
+/*
+缓冲区无法放入时,BUFFER_SPOOL写入存储,其他策略丢弃
+*/
+func (r *RabbitPool) bufferOverflow(data *RabbitMqData, reason error) *RabbitMqError {
+	if r.bufferPolicy != BUFFER_SPOOL {
+		return NewRabbitMqError(RCODE_BUFFER_FULL_ERROR, reason.Error()+",消息被丢弃", "")
+	}
+	if store, err := r.getFailoverStore(data); err == nil && store == nil {
+		return NewRabbitMqError(RCODE_BUFFER_FULL_ERROR, reason.Error()+",未配置存储,消息被丢弃", "")
+	}
+	return spoolResult(reason.Error(), r.spoolData(data, reason.Error(), 0))
+}
+
+/*
+断线缓冲区发送
+
+定时检查连接,断开时尝试重连,连接正常后按顺序发送缓冲区中的消息,
+随连接池启动,Close时退出
+*/
+func (r *RabbitPool) runBuffer() {
+	defer r.bufferWait.Done()
+	if r.buffer == nil {
+		return
+	}
+	ticker := time.NewTicker(DEFAULT_BUFFER_DRAIN_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.closeChan:
+			return
+		case <-ticker.C:
+			if len(r.buffer) > 0 && r.reconnect() {
+				r.drainBuffer()
+			}
+		}
+	}
+}
+
+func (r *RabbitPool) drainBuffer() {
+	var sent int
+	ctx, cancel := r.closeContext()
+	defer cancel()
+	for r.IsHealthy() {
+		select {
+		case <-r.closeChan:
+			return
+		case data := <-r.buffer:
+			//等待令牌时连接池关闭,消息写入存储
+			if err := r.limitWait(ctx, data); err != nil {
+				if err = r.spoolData(data, "连接池关闭时缓冲区未发送", 0); err != nil && !errors.Is(err, ErrFailoverStoreDropped) {
+					rmqlog(fmt.Sprintf("缓冲区消息丢失: %s", err))
+				}
+				return
+			}
+			if err := rPush(r, data, 1); err != nil {
+				rmqlog(fmt.Sprintf("缓冲区消息发送失败: %s", err))
+			} else {
+				sent++
+			}
+		default:
+			if sent > 0 {
+				rmqlog(fmt.Sprintf("缓冲区消息发送完成: %d条", sent))
+			}
+			return
+		}
+	}
+}
+
+/*
+尝试重连一个断开的连接,连接正常时返回true
+*/
+func (r *RabbitPool) reconnect() bool {
+	r.channelLock.Lock()
+	defer r.channelLock.Unlock()
+	rc := r.getConnection()
+	if rc == nil {
+		return false
+	}
+	if rc.conn != nil && !rc.conn.IsClosed() {
+		return true
+	}
+	conn, err := rConnect(r, true, rc.index)
+	if err != nil {
+		return false
+	}
+	r.setConn(rc, conn)
+	rmqlog("连接已恢复")
+	return true
+}
+
+/*
+关闭缓冲区,Close时在关闭存储之前调用
+等待正在放入的调用返回后,剩余消息写入存储
+*/
+func (r *RabbitPool) closeBuffer() {
+	r.bufferLock.Lock()
+	r.bufferClosed = true
+	r.bufferLock.Unlock()
+	for {
+		select {
+		case data := <-r.buffer:
+			if err := r.spoolData(data, "连接池关闭时缓冲区未发送", 0); err != nil && !errors.Is(err, ErrFailoverStoreDropped) {
+				rmqlog(fmt.Sprintf("缓冲区消息丢失: %s", err))
+			}
+		default:
+			return
+		}
+	}
+}
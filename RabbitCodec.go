@@ -0,0 +1,164 @@
+package rabbitmqpool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrCodecNotFound = errors.New("codec not found")
+)
+
+const (
+	CONTENT_TYPE_JSON = "application/json"
+
+	DECODE_REQUEUE_DELAY = 200 * time.Millisecond //解码失败重新入队前的等待时间,避免同一消息被立即重复投递
+)
+
+/*
+消息编解码
+
+按ContentType注册,发送时设置消息的content-type,消费时按content-type选择解码
+*/
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string { return CONTENT_TYPE_JSON }
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+var (
+	codecLock sync.RWMutex
+	codecs    = map[string]Codec{CONTENT_TYPE_JSON: JSONCodec{}}
+)
+
+/*
+注册编解码,相同ContentType的会被替换
+如protobuf(application/x-protobuf)、msgpack(application/msgpack)
+*/
+func RegisterCodec(codec Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecs[normalizeContentType(codec.ContentType())] = codec
+}
+
+/*
+按ContentType获取编解码,忽略charset等参数,为空时使用json
+Push默认的text/plain及设置Body时的application/octet-stream未注册编解码时也使用json
+*/
+func GetCodec(contentType string) (Codec, error) {
+	mediaType := normalizeContentType(contentType)
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	if codec, ok := codecs[mediaType]; ok {
+		return codec, nil
+	}
+	switch mediaType {
+	case "", DEFAULT_CONTENT_TYPE, DEFAULT_BINARY_CONTENT_TYPE:
+		return codecs[CONTENT_TYPE_JSON], nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrCodecNotFound, contentType)
+}
+
+func normalizeContentType(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+/*
+获取编码后的发送数据模板
+@param exChangeName 交换机名称
+@param exChangeType 交换机类型
+@param queueName string 队列名称
+@param route string 路由
+@param v interface{} 发送的数据,按contentType编码
+@param contentType string 为空时使用json
+*/
+func GetRabbitMqDataFormatValue(exChangeName string, exChangeType string, queueName string, route string, v interface{}, contentType string, localFile string) (*RabbitMqData, error) {
+	codec, err := GetCodec(contentType)
+	if err != nil {
+		return nil, err
+	}
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	data := GetRabbitMqDataFormatBytes(exChangeName, exChangeType, queueName, route, body, localFile)
+	data.ContentType = codec.ContentType()
+	return data, nil
+}
+
+/*
+消费者收到消息后回调,设置了EventDecoded时解码后回调,否则回调EventSuccess
+*/
+func (c *ConsumeReceive) dispatch(delivery *amqp.Delivery, retryClient RetryClientInterface, sLogger *zap.SugaredLogger) (bool, error) {
+	if c.EventDecoded == nil {
+		return c.EventSuccess(delivery.Body, delivery.Headers, retryClient, sLogger), nil
+	}
+	v, err := c.decode(delivery)
+	if err != nil {
+		return false, err
+	}
+	return c.EventDecoded(v, delivery, retryClient, sLogger), nil
+}
+
+/*
+消息解码失败,回调EventFail后:
+设置了重试时进入重试队列,超过最大次数后回调EventFail(RCODE_RETRY_MAX_ERROR);
+否则首次投递的消息等待DECODE_REQUEUE_DELAY后重新入队一次,等待注册对应的编解码后再消费,
+重新投递后仍无法解码的消息拒绝且不重新入队(队列设置了死信交换机时进入死信队列),避免一直重复投递
+*/
+func (c *ConsumeReceive) decodeFailed(pool *RabbitPool, delivery *amqp.Delivery, retryClient RetryClientInterface, err error) {
+	if c.EventFail != nil {
+		c.EventFail(RCODE_DECODE_ERROR, NewRabbitMqError(RCODE_DECODE_ERROR, "消息解码失败", err.Error()), delivery.Body)
+	}
+	if c.IsTry && retryClient.Push(delivery.Body) == nil {
+		_ = retryClient.Ack()
+		return
+	}
+	//自动确认的消息已被确认,无法重新入队
+	if c.IsAutoAck {
+		return
+	}
+	if delivery.Redelivered {
+		_ = delivery.Nack(false, false)
+		return
+	}
+	select {
+	case <-time.After(DECODE_REQUEUE_DELAY):
+	case <-pool.closeChan:
+	}
+	_ = delivery.Nack(false, true)
+}
+
+func (c *ConsumeReceive) decode(delivery *amqp.Delivery) (interface{}, error) {
+	codec, err := GetCodec(delivery.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	if c.NewValue == nil {
+		var v interface{}
+		err = codec.Unmarshal(delivery.Body, &v)
+		return v, err
+	}
+	v := c.NewValue()
+	err = codec.Unmarshal(delivery.Body, v)
+	return v, err
+}
@@ -0,0 +1,483 @@
+package rabbitmqpool
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidConfig = errors.New("invalid config")
+)
+
+/*
+文件及环境变量配置
+
+yaml/json字段名与环境变量一一对应: 前缀_字段路径(大写,层级以_连接),
+如前缀为RABBITMQ时 tls.ca_file 对应 RABBITMQ_TLS_CA_FILE,
+列表以逗号分隔,时间为Go duration格式,如"30s"
+*/
+type RabbitConfig struct {
+	Host             string   `yaml:"host" json:"host"`
+	Port             int      `yaml:"port" json:"port"`                           //为0时amqp使用5672,amqps使用5671
+	Hosts            []string `yaml:"hosts" json:"hosts"`                         //集群其他节点,host:port,省略端口时使用port
+	EndpointStrategy string   `yaml:"endpoint_strategy" json:"endpoint_strategy"` //ordered/shuffle/round_robin
+	User             string   `yaml:"user" json:"user"`
+	Password         string   `yaml:"password" json:"password"`
+	UserFile         string   `yaml:"user_file" json:"user_file"`           //用户名文件,每次连接时读取,替代user
+	PasswordFile     string   `yaml:"password_file" json:"password_file"`   //密码文件,每次连接时读取,替代password
+	AuthMechanism    []string `yaml:"auth_mechanism" json:"auth_mechanism"` //plain/amqplain/external,按顺序使用第一个服务端支持的方式
+	VHost            string   `yaml:"vhost" json:"vhost"`
+	Type             string   `yaml:"type" json:"type"` //producer/consumer,默认producer
+
+	MaxConnection     int `yaml:"max_connection" json:"max_connection"`           //最大连接数
+	MaxConsumeChannel int `yaml:"max_consume_channel" json:"max_consume_channel"` //消费者最大信道数
+
+	Heartbeat      string `yaml:"heartbeat" json:"heartbeat"`       //心跳间隔,为0s时关闭心跳
+	DialTimeout    string `yaml:"dial_timeout" json:"dial_timeout"` //建立连接超时时间
+	FrameMax       int    `yaml:"frame_max" json:"frame_max"`       //最大帧大小
+	ChannelMax     int    `yaml:"channel_max" json:"channel_max"`   //每个连接的最大信道数
+	Locale         string `yaml:"locale" json:"locale"`
+	ConnectionName string `yaml:"connection_name" json:"connection_name"` //连接名称中的应用名
+
+	PublisherConfirm bool   `yaml:"publisher_confirm" json:"publisher_confirm"` //是否开启发布确认
+	ConfirmTimeout   string `yaml:"confirm_timeout" json:"confirm_timeout"`     //等待发布确认超时时间
+
+	Retry RabbitRetryConfig `yaml:"retry" json:"retry"`
+	TLS   RabbitTLSConfig   `yaml:"tls" json:"tls"`
+	Spool RabbitSpoolConfig `yaml:"spool" json:"spool"`
+}
+
+/*
+重试配置
+*/
+type RabbitRetryConfig struct {
+	PushMaxTime     int   `yaml:"push_max_time" json:"push_max_time"`         //单条消息最大重发次数
+	ProductMaxRetry int   `yaml:"product_max_retry" json:"product_max_retry"` //生产者断线重连最大次数
+	ConsumeMaxRetry int   `yaml:"consume_max_retry" json:"consume_max_retry"` //消费者断线重连最大次数
+	MinRandomTime   int64 `yaml:"min_random_time" json:"min_random_time"`     //随机重试时间(毫秒)
+	MaxRandomTime   int64 `yaml:"max_random_time" json:"max_random_time"`
+}
+
+/*
+amqps配置,enabled为true或设置任意证书时使用amqps
+*/
+type RabbitTLSConfig struct {
+	Enabled    bool   `yaml:"enabled" json:"enabled"`
+	CAFile     string `yaml:"ca_file" json:"ca_file"`
+	CertFile   string `yaml:"cert_file" json:"cert_file"`
+	KeyFile    string `yaml:"key_file" json:"key_file"`
+	ServerName string `yaml:"server_name" json:"server_name"`
+	MinVersion string `yaml:"min_version" json:"min_version"` //1.0/1.1/1.2/1.3,默认1.2
+}
+
+/*
+本地文件存储配置
+*/
+type RabbitSpoolConfig struct {
+	Dir            string `yaml:"dir" json:"dir"`
+	ReturnSpool    bool   `yaml:"return_spool" json:"return_spool"`       //被退回的消息是否写入本地文件
+	ReplayInterval string `yaml:"replay_interval" json:"replay_interval"` //重发间隔,为0s时不重发
+	ReplayBatch    int    `yaml:"replay_batch" json:"replay_batch"`       //每次重发的最大条数
+	MaxBytes       int64  `yaml:"max_bytes" json:"max_bytes"`
+	MaxEntries     int64  `yaml:"max_entries" json:"max_entries"`
+	SegmentBytes   int64  `yaml:"segment_bytes" json:"segment_bytes"`
+	Overflow       string `yaml:"overflow" json:"overflow"`           //reject/drop_oldest/block
+	BlockTimeout   string `yaml:"block_timeout" json:"block_timeout"` //overflow为block时的最长等待时间
+	Sync           string `yaml:"sync" json:"sync"`                   //always/interval/never
+	SyncInterval   string `yaml:"sync_interval" json:"sync_interval"`
+	LockTimeout    string `yaml:"lock_timeout" json:"lock_timeout"`
+	EncryptionKey  string `yaml:"encryption_key" json:"encryption_key"` //base64编码的16/24/32字节密钥
+}
+
+/*
+读取配置文件,按扩展名解析yaml(.yaml/.yml)或json(.json),
+包含未知字段时返回错误
+*/
+func LoadConfigFile(path string) (*RabbitConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取配置文件失败: %w", err)
+	}
+	c := &RabbitConfig{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	default:
+		return nil, fmt.Errorf("%w: 不支持的配置文件类型: %s", ErrInvalidConfig, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: 解析配置文件%s失败: %s", ErrInvalidConfig, path, err)
+	}
+	return c, nil
+}
+
+/*
+读取带前缀的环境变量,已设置的环境变量覆盖文件中的值
+
+@param prefix string: 环境变量前缀,如RABBITMQ
+*/
+func (c *RabbitConfig) LoadEnv(prefix string) error {
+	return loadEnv(reflect.ValueOf(c).Elem(), strings.ToUpper(strings.TrimSuffix(prefix, "_")))
+}
+
+func loadEnv(v reflect.Value, prefix string) error {
+	var errs []error
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := prefix + "_" + strings.ToUpper(t.Field(i).Tag.Get("yaml"))
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			errs = append(errs, loadEnv(field, name))
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%w: %s: 无效的布尔值: %s", ErrInvalidConfig, name, value))
+				continue
+			}
+			field.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%w: %s: 无效的整数: %s", ErrInvalidConfig, name, value))
+				continue
+			}
+			field.SetInt(n)
+		case reflect.Slice:
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+/*
+校验配置,返回所有无效的字段
+*/
+func (c *RabbitConfig) Validate() error {
+	_, err := c.options()
+	return err
+}
+
+/*
+校验配置并创建amqpConfig,opts在配置之后应用,可覆盖配置中的设置
+*/
+func (c *RabbitConfig) AmqpConf(opts ...funcOption) (*amqpConfig, error) {
+	cfgOpts, err := c.options()
+	if err != nil {
+		return nil, err
+	}
+	return NewAmqpConf(c.Host, c.port(), c.User, c.Password, append(cfgOpts, opts...)...), nil
+}
+
+/*
+从配置文件及环境变量创建amqpConfig,环境变量优先
+
+@param path string: 配置文件,为空时只读取环境变量
+@param envPrefix string: 环境变量前缀,为空时不读取环境变量
+*/
+func LoadAmqpConf(path string, envPrefix string, opts ...funcOption) (*amqpConfig, error) {
+	c := &RabbitConfig{}
+	if path != "" {
+		fileConf, err := LoadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		c = fileConf
+	}
+	if envPrefix != "" {
+		if err := c.LoadEnv(envPrefix); err != nil {
+			return nil, err
+		}
+	}
+	return c.AmqpConf(opts...)
+}
+
+func (c *RabbitConfig) tlsEnabled() bool {
+	return c.TLS.Enabled || c.TLS.CAFile != "" || c.TLS.CertFile != "" || c.TLS.KeyFile != ""
+}
+
+func (c *RabbitConfig) port() int {
+	if c.Port != 0 {
+		return c.Port
+	}
+	if c.tlsEnabled() {
+		return 5671
+	}
+	return 5672
+}
+
+/*
+配置转换为funcOption,同时收集所有校验错误
+*/
+func (c *RabbitConfig) options() ([]funcOption, error) {
+	var opts []funcOption
+	var errs []error
+	invalid := func(field string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%w: %s: %s", ErrInvalidConfig, field, fmt.Sprintf(format, args...)))
+	}
+	duration := func(field string, value string) time.Duration {
+		if value == "" {
+			return 0
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			invalid(field, "无效的时间: %s", value)
+			return 0
+		}
+		return d
+	}
+	positive := func(field string, n int64) {
+		if n < 0 {
+			invalid(field, "不能为负数: %d", n)
+		}
+	}
+
+	if c.Host == "" {
+		invalid("host", "不能为空")
+	}
+	port := c.port()
+	if port < 1 || port > 65535 {
+		invalid("port", "无效的端口: %d", c.Port)
+	}
+	for _, h := range c.Hosts {
+		host, p, err := net.SplitHostPort(h)
+		if err != nil {
+			if strings.Contains(h, ":") {
+				invalid("hosts", "无效的地址: %s", h)
+				continue
+			}
+			opts = append(opts, WithEndpoint(h, port))
+			continue
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 || host == "" {
+			invalid("hosts", "无效的地址: %s", h)
+			continue
+		}
+		opts = append(opts, WithEndpoint(host, n))
+	}
+	switch c.EndpointStrategy {
+	case "", "ordered":
+	case "shuffle":
+		opts = append(opts, WithEndpointStrategy(ENDPOINT_SHUFFLE))
+	case "round_robin":
+		opts = append(opts, WithEndpointStrategy(ENDPOINT_ROUND_ROBIN))
+	default:
+		invalid("endpoint_strategy", "应为ordered/shuffle/round_robin: %s", c.EndpointStrategy)
+	}
+	external := false
+	var mechanisms []int
+	for _, name := range c.AuthMechanism {
+		mechanism, err := parseAuthMechanism(name)
+		if err != nil {
+			invalid("auth_mechanism", "应为plain/amqplain/external: %s", name)
+			continue
+		}
+		external = external || mechanism == AUTH_EXTERNAL
+		mechanisms = append(mechanisms, mechanism)
+	}
+	if len(mechanisms) > 0 {
+		opts = append(opts, WithAuthMechanism(mechanisms...))
+	}
+	if external && c.TLS.CertFile == "" {
+		invalid("auth_mechanism", "external需要设置tls.cert_file及tls.key_file")
+	}
+	if c.User == "" && c.UserFile == "" && !external {
+		invalid("user", "不能为空")
+	}
+	if c.UserFile != "" && c.PasswordFile == "" {
+		invalid("user_file", "需同时设置password_file")
+	}
+	if c.PasswordFile != "" {
+		opts = append(opts, WithCredentialsProvider(NewFileCredentials(c.UserFile, c.PasswordFile)))
+	}
+	if c.VHost != "" {
+		opts = append(opts, WithRabbitvHost(c.VHost))
+	}
+	switch c.Type {
+	case "", "producer":
+		opts = append(opts, WithRabbitType(RABBITMQ_TYPE_PUBLISH))
+	case "consumer":
+		opts = append(opts, WithRabbitType(RABBITMQ_TYPE_CONSUME))
+	default:
+		invalid("type", "应为producer/consumer: %s", c.Type)
+	}
+
+	positive("max_connection", int64(c.MaxConnection))
+	positive("max_consume_channel", int64(c.MaxConsumeChannel))
+	opts = append(opts, WithMaxConnection(int32(c.MaxConnection)), WithMaxConsumeChannel(int32(c.MaxConsumeChannel)))
+	if c.Heartbeat != "" {
+		opts = append(opts, WithHeartbeat(duration("heartbeat", c.Heartbeat)))
+	}
+	if dialTimeout := duration("dial_timeout", c.DialTimeout); dialTimeout > 0 {
+		opts = append(opts, WithDialTimeout(dialTimeout))
+	}
+	positive("frame_max", int64(c.FrameMax))
+	if c.ChannelMax < 0 || c.ChannelMax > 65535 {
+		invalid("channel_max", "应为0-65535: %d", c.ChannelMax)
+	}
+	opts = append(opts, WithFrameMax(c.FrameMax), WithChannelMax(uint16(c.ChannelMax)))
+	if c.Locale != "" {
+		opts = append(opts, WithLocale(c.Locale))
+	}
+	if c.ConnectionName != "" {
+		opts = append(opts, WithConnectionName(c.ConnectionName))
+	}
+	if confirmTimeout := duration("confirm_timeout", c.ConfirmTimeout); c.PublisherConfirm {
+		opts = append(opts, WithPublisherConfirm(confirmTimeout))
+	}
+
+	retry := c.Retry
+	positive("retry.push_max_time", int64(retry.PushMaxTime))
+	positive("retry.product_max_retry", int64(retry.ProductMaxRetry))
+	positive("retry.consume_max_retry", int64(retry.ConsumeMaxRetry))
+	positive("retry.min_random_time", retry.MinRandomTime)
+	positive("retry.max_random_time", retry.MaxRandomTime)
+	if retry.MinRandomTime > retry.MaxRandomTime {
+		invalid("retry.min_random_time", "不能大于max_random_time")
+	}
+	opts = append(opts,
+		WithPushMaxTime(retry.PushMaxTime),
+		WithMaxRetry(int32(retry.ProductMaxRetry), int32(retry.ConsumeMaxRetry)),
+		WithRandomRetryTime(retry.MinRandomTime, retry.MaxRandomTime),
+	)
+
+	if c.tlsEnabled() {
+		opts = append(opts, WithTLS(nil))
+		if c.TLS.CAFile != "" {
+			opts = append(opts, WithTLSCA(c.TLS.CAFile))
+		}
+		if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+			invalid("tls", "cert_file与key_file需同时设置")
+		} else if c.TLS.CertFile != "" {
+			opts = append(opts, WithTLSClientCert(c.TLS.CertFile, c.TLS.KeyFile))
+		}
+		if c.TLS.ServerName != "" {
+			opts = append(opts, WithTLSServerName(c.TLS.ServerName))
+		}
+		if c.TLS.MinVersion != "" {
+			versions := map[string]uint16{
+				"1.0": tls.VersionTLS10,
+				"1.1": tls.VersionTLS11,
+				"1.2": tls.VersionTLS12,
+				"1.3": tls.VersionTLS13,
+			}
+			if version, ok := versions[c.TLS.MinVersion]; ok {
+				opts = append(opts, WithTLSMinVersion(version))
+			} else {
+				invalid("tls.min_version", "应为1.0/1.1/1.2/1.3: %s", c.TLS.MinVersion)
+			}
+		}
+	}
+
+	spool := c.Spool
+	if spool.Dir != "" {
+		opts = append(opts, WithSpoolDir(spool.Dir))
+	}
+	if spool.ReturnSpool {
+		opts = append(opts, WithReturnSpool(true))
+	}
+	if spool.ReplayInterval != "" {
+		opts = append(opts, WithReplayInterval(duration("spool.replay_interval", spool.ReplayInterval)))
+	}
+	positive("spool.replay_batch", int64(spool.ReplayBatch))
+	opts = append(opts, WithReplayBatchSize(spool.ReplayBatch))
+	var storeOpts []storeOption
+	positive("spool.max_bytes", spool.MaxBytes)
+	positive("spool.max_entries", spool.MaxEntries)
+	positive("spool.segment_bytes", spool.SegmentBytes)
+	if spool.MaxBytes > 0 {
+		storeOpts = append(storeOpts, WithStoreMaxBytes(spool.MaxBytes))
+	}
+	if spool.MaxEntries > 0 {
+		storeOpts = append(storeOpts, WithStoreMaxEntries(spool.MaxEntries))
+	}
+	if spool.SegmentBytes > 0 {
+		storeOpts = append(storeOpts, WithStoreSegmentBytes(spool.SegmentBytes))
+	}
+	blockTimeout := duration("spool.block_timeout", spool.BlockTimeout)
+	switch spool.Overflow {
+	case "":
+	case "reject":
+		storeOpts = append(storeOpts, WithStoreOverflow(OVERFLOW_REJECT, 0))
+	case "drop_oldest":
+		storeOpts = append(storeOpts, WithStoreOverflow(OVERFLOW_DROP_OLDEST, 0))
+	case "block":
+		storeOpts = append(storeOpts, WithStoreOverflow(OVERFLOW_BLOCK, blockTimeout))
+	default:
+		invalid("spool.overflow", "应为reject/drop_oldest/block: %s", spool.Overflow)
+	}
+	syncInterval := duration("spool.sync_interval", spool.SyncInterval)
+	switch spool.Sync {
+	case "":
+		if syncInterval > 0 {
+			storeOpts = append(storeOpts, WithStoreSync(FSYNC_INTERVAL, syncInterval))
+		}
+	case "always":
+		storeOpts = append(storeOpts, WithStoreSync(FSYNC_ALWAYS, 0))
+	case "interval":
+		storeOpts = append(storeOpts, WithStoreSync(FSYNC_INTERVAL, syncInterval))
+	case "never":
+		storeOpts = append(storeOpts, WithStoreSync(FSYNC_NEVER, 0))
+	default:
+		invalid("spool.sync", "应为always/interval/never: %s", spool.Sync)
+	}
+	if spool.LockTimeout != "" {
+		storeOpts = append(storeOpts, WithStoreLockTimeout(duration("spool.lock_timeout", spool.LockTimeout)))
+	}
+	if spool.EncryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(spool.EncryptionKey)
+		switch {
+		case err != nil:
+			invalid("spool.encryption_key", "不是有效的base64")
+		case len(key) != 16 && len(key) != 24 && len(key) != 32:
+			invalid("spool.encryption_key", "密钥长度应为16/24/32字节: %d", len(key))
+		default:
+			storeOpts = append(storeOpts, WithStoreEncryptionKey(key))
+		}
+	}
+	if len(storeOpts) > 0 {
+		opts = append(opts, WithSpoolOptions(storeOpts...))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
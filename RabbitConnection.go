@@ -0,0 +1,149 @@
+package rabbitmqpool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	DEFAULT_LOCALE = "en_US" //连接使用的locale
+)
+
+/*
+设置心跳间隔,为0时关闭心跳,未设置时为10秒
+
+@param heartbeat time.Duration: 按秒取整,大于0且不足1秒时为1秒
+*/
+func WithHeartbeat(heartbeat time.Duration) funcOption {
+	return func(o *amqpConfig) {
+		o.heartbeat = heartbeat
+		o.heartbeatSet = true
+	}
+}
+
+/*
+设置连接的locale,默认en_US
+*/
+func WithLocale(locale string) funcOption {
+	return func(o *amqpConfig) {
+		o.locale = locale
+	}
+}
+
+/*
+设置最大帧大小(字节),为0时由服务端决定
+*/
+func WithFrameMax(frameMax int) funcOption {
+	return func(o *amqpConfig) {
+		o.frameMax = frameMax
+	}
+}
+
+/*
+设置每个连接的最大信道数,为0时由服务端决定
+*/
+func WithChannelMax(channelMax uint16) funcOption {
+	return func(o *amqpConfig) {
+		o.channelMax = channelMax
+	}
+}
+
+/*
+设置建立连接(tcp及tls握手)的超时时间,为0时为30秒
+*/
+func WithDialTimeout(timeout time.Duration) funcOption {
+	return func(o *amqpConfig) {
+		o.dialTimeout = timeout
+	}
+}
+
+/*
+设置连接名称中的应用名,管理界面中连接显示为 应用名-producer/consumer-序号
+
+@param app string: 为空时使用程序文件名
+*/
+func WithConnectionName(app string) funcOption {
+	return func(o *amqpConfig) {
+		o.connectionName = app
+	}
+}
+
+/*
+设置连接的客户端属性,与默认属性(product/version/platform)合并,
+设置connection_name时替代WithConnectionName生成的名称
+*/
+func WithClientProperties(properties amqp.Table) funcOption {
+	return func(o *amqpConfig) {
+		if o.clientProperties == nil {
+			o.clientProperties = amqp.Table{}
+		}
+		for k, v := range properties {
+			o.clientProperties[k] = v
+		}
+	}
+}
+
+/*
+连接池中第index个连接的名称
+*/
+func (r *RabbitPool) connectionName(index int32) string {
+	app := r.appName
+	if app == "" {
+		app = filepath.Base(os.Args[0])
+	}
+	clientType := "producer"
+	if r.clientType == RABBITMQ_TYPE_CONSUME {
+		clientType = "consumer"
+	}
+	return fmt.Sprintf("%s-%s-%d", app, clientType, index)
+}
+
+/*
+连接的客户端属性,DialConfig会修改属性表,每次连接使用新表
+*/
+func (r *RabbitPool) connectionProperties(index int32) amqp.Table {
+	properties := amqp.NewConnectionProperties()
+	for k, v := range r.clientProperties {
+		properties[k] = v
+	}
+	if _, ok := properties["connection_name"]; !ok {
+		properties.SetClientConnectionName(r.connectionName(index))
+	}
+	return properties
+}
+
+/*
+连接单个节点
+
+@param index int32: 连接在连接池中的序号,用于连接名称
+*/
+func (r *RabbitPool) dial(e endpoint, index int32) (*amqp.Connection, error) {
+	user, password, err := r.connectionCredentials()
+	if err != nil {
+		return nil, err
+	}
+	locale := r.locale
+	if locale == "" {
+		locale = DEFAULT_LOCALE
+	}
+	config := amqp.Config{
+		Vhost:      vhostName(r.virtualHost),
+		ChannelMax: r.channelMax,
+		FrameSize:  r.frameMax,
+		Locale:     locale,
+		Properties: r.connectionProperties(index),
+		SASL:       r.saslAuth(user, password),
+	}
+	if r.tlsConfig != nil {
+		//DialConfig会修改ServerName,每次连接使用副本
+		config.TLSClientConfig = r.tlsConfig.Clone()
+	}
+	if r.dialTimeout > 0 {
+		config.Dial = amqp.DefaultDial(r.dialTimeout)
+	}
+	return amqp.DialConfig(r.connectionURL(e, user, password), config)
+}
@@ -0,0 +1,129 @@
+package rabbitmqpool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+连接凭据,每次建立连接(包括断线重连)时获取
+返回的用户名为空时使用NewAmqpConf中的用户名
+*/
+type CredentialsProvider interface {
+	Credentials() (user string, password string, err error)
+}
+
+type staticCredentials struct {
+	user     string
+	password string
+}
+
+/*
+固定的用户名和密码
+*/
+func NewStaticCredentials(user string, password string) CredentialsProvider {
+	return &staticCredentials{user: user, password: password}
+}
+
+func (c *staticCredentials) Credentials() (string, string, error) {
+	return c.user, c.password, nil
+}
+
+/*
+从文件读取的凭据,适用于挂载的secret文件
+
+文件内容去掉首尾空白后作为用户名/密码,文件修改后下次连接时重新读取,
+读取失败时(如secret更新时文件被短暂替换)使用上次读取成功的值
+*/
+type FileCredentials struct {
+	userFile     string
+	passwordFile string
+	lock         sync.Mutex
+	user         fileSecret
+	password     fileSecret
+}
+
+type fileSecret struct {
+	value   string
+	modTime time.Time
+	size    int64
+	loaded  bool
+}
+
+/*
+@param userFile string: 用户名文件,为空时使用NewAmqpConf中的用户名
+@param passwordFile string: 密码文件
+*/
+func NewFileCredentials(userFile string, passwordFile string) *FileCredentials {
+	return &FileCredentials{userFile: userFile, passwordFile: passwordFile}
+}
+
+func (c *FileCredentials) Credentials() (string, string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var errs []error
+	if c.userFile != "" {
+		errs = append(errs, c.user.refresh(c.userFile))
+	}
+	errs = append(errs, c.password.refresh(c.passwordFile))
+	if err := errors.Join(errs...); err != nil {
+		return "", "", err
+	}
+	return c.user.value, c.password.value, nil
+}
+
+/*
+文件大小或修改时间变化时重新读取
+*/
+func (s *fileSecret) refresh(path string) error {
+	info, err := os.Stat(path)
+	if err == nil && s.loaded && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+	var b []byte
+	if err == nil {
+		b, err = os.ReadFile(path)
+	}
+	if err != nil {
+		if s.loaded {
+			rmqlog(fmt.Sprintf("读取凭据文件%s失败,使用上次读取的值: %s", path, err))
+			return nil
+		}
+		return fmt.Errorf("读取凭据文件失败: %w", err)
+	}
+	s.value = strings.TrimSpace(string(b))
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	s.loaded = true
+	return nil
+}
+
+/*
+设置连接凭据,设置后NewAmqpConf中的密码不再使用
+*/
+func WithCredentialsProvider(provider CredentialsProvider) funcOption {
+	return func(o *amqpConfig) {
+		o.credentials = provider
+	}
+}
+
+/*
+本次连接使用的用户名和密码
+*/
+func (r *RabbitPool) connectionCredentials() (string, string, error) {
+	if r.credentials == nil {
+		return r.user, r.password, nil
+	}
+	user, password, err := r.credentials.Credentials()
+	if err != nil {
+		return "", "", fmt.Errorf("获取连接凭据失败: %w", err)
+	}
+	if user == "" {
+		user = r.user
+	}
+	return user, password, nil
+}
@@ -1,5 +1,16 @@
 package rabbitmqpool
 
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	DEFAULT_CONTENT_TYPE        = "text/plain"
+	DEFAULT_BINARY_CONTENT_TYPE = "application/octet-stream" //设置Body时的默认类型
+)
+
 /*
 发送数据
 消息发送
@@ -10,7 +21,56 @@ type RabbitMqData struct {
 	QueueName    string //队列名称
 	Route        string //路由
 	Data         string //发送数据
-	Localfile    string //本地文件用于保存发送失败的数据
+	Body         []byte //二进制数据,不为nil时代替Data发送,写入本地文件时base64编码
+	Localfile    string //本地目录用于保存发送失败的数据,为空时使用连接池配置;以.txt结尾时使用去掉扩展名的目录
+	Mandatory    bool   //无法路由时由broker退回,Push返回RCODE_PUSH_RETURN_ERROR;按MessageId关联退回结果,为空时自动生成
+
+	//消息属性,写入本地文件后重发时保留
+	Headers         amqp.Table //消息头,写入本地文件时按类型保存,重发时还原
+	ContentType     string     //为空时为text/plain,设置Body时为application/octet-stream
+	ContentEncoding string
+	DeliveryMode    uint8 //amqp.Transient或amqp.Persistent,为0时持久化
+	Priority        uint8 //0-9
+	CorrelationId   string
+	ReplyTo         string
+	Expiration      string //消息过期时间,毫秒
+	MessageId       string
+	Timestamp       time.Time
+	Type            string
+	AppId           string
+
+	replay bool //本地文件重发的数据,发送失败时不再写入本地文件
+}
+
+/*
+转换为amqp消息
+*/
+func (d *RabbitMqData) publishing() amqp.Publishing {
+	msg := amqp.Publishing{
+		Headers:         d.Headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.body(),
+	}
+	if msg.ContentType == "" {
+		msg.ContentType = DEFAULT_CONTENT_TYPE
+		if d.Body != nil {
+			msg.ContentType = DEFAULT_BINARY_CONTENT_TYPE
+		}
+	}
+	if msg.DeliveryMode == 0 {
+		msg.DeliveryMode = amqp.Persistent //持久化到磁盘
+	}
+	return msg
 }
 
 /*
@@ -32,9 +92,38 @@ func GetRabbitMqDataFormat(exChangeName string, exChangeType string, queueName s
 	}
 }
 
+/*
+发送的消息体
+*/
+func (d *RabbitMqData) body() []byte {
+	if d.Body != nil {
+		return d.Body
+	}
+	return []byte(d.Data)
+}
+
+/*
+获取二进制数据发送模板
+@param exChangeName 交换机名称
+@param exChangeType 交换机类型
+@param queueName string 队列名称
+@param route string 路由
+@param body []byte 发送的数据
+*/
+func GetRabbitMqDataFormatBytes(exChangeName string, exChangeType string, queueName string, route string, body []byte, localFile string) *RabbitMqData {
+	return &RabbitMqData{
+		ExchangeName: exChangeName,
+		ExchangeType: exChangeType,
+		QueueName:    queueName,
+		Route:        route,
+		Body:         body,
+		Localfile:    localFile,
+	}
+}
+
 /*
 获取发送数据模板
-过期设置(死信队列)
+过期设置(死信队列),过期时间通过Expiration设置
 @param exChangeName 交换机名称
 @param exChangeType 交换机类型
 @param queueName string 队列名称
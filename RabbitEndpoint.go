@@ -0,0 +1,91 @@
+package rabbitmqpool
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+/*
+多节点连接策略
+*/
+const (
+	ENDPOINT_ORDERED     = 1 //按顺序连接,前面的节点不可用时依次尝试后面的节点
+	ENDPOINT_SHUFFLE     = 2 //每次连接随机打乱节点顺序
+	ENDPOINT_ROUND_ROBIN = 3 //每次连接从下一个节点开始,连接分散到各节点
+)
+
+/*
+rabbitmq节点
+*/
+type endpoint struct {
+	host string
+	port int
+}
+
+func (e endpoint) String() string {
+	return net.JoinHostPort(e.host, strconv.Itoa(e.port))
+}
+
+/*
+添加集群节点,NewAmqpConf的host/port为第一个节点,可多次调用
+*/
+func WithEndpoint(host string, port int) funcOption {
+	return func(o *amqpConfig) {
+		o.endpoints = append(o.endpoints, endpoint{host: host, port: port})
+	}
+}
+
+/*
+设置多节点连接策略 ENDPOINT_ORDERED(默认)/ENDPOINT_SHUFFLE/ENDPOINT_ROUND_ROBIN
+*/
+func WithEndpointStrategy(strategy int) funcOption {
+	return func(o *amqpConfig) {
+		o.endpointStrategy = strategy
+	}
+}
+
+/*
+本次连接尝试节点的顺序
+*/
+func (r *RabbitPool) endpointOrder() []endpoint {
+	n := len(r.endpoints)
+	order := make([]endpoint, n)
+	switch r.endpointStrategy {
+	case ENDPOINT_SHUFFLE:
+		for i, j := range rand.Perm(n) {
+			order[i] = r.endpoints[j]
+		}
+	case ENDPOINT_ROUND_ROBIN:
+		start := int(atomic.AddUint32(&r.endpointIndex, 1)-1) % n
+		for i := range order {
+			order[i] = r.endpoints[(start+i)%n]
+		}
+	default:
+		copy(order, r.endpoints)
+	}
+	return order
+}
+
+/*
+按策略依次连接各节点,返回第一个连接成功的节点
+*/
+func (r *RabbitPool) dialEndpoints(index int32) (*amqp.Connection, error) {
+	var errs []error
+	for i, e := range r.endpointOrder() {
+		client, err := r.dial(e, index)
+		if err == nil {
+			if i > 0 {
+				rmqlog(fmt.Sprintf("已切换到节点 %s", e))
+			}
+			return client, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", e, err))
+	}
+	return nil, errors.Join(errs...)
+}
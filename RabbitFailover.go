@@ -0,0 +1,411 @@
+package rabbitmqpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFailoverStoreFull    = errors.New("failover store full")
+	ErrFailoverStoreDropped = errors.New("failover store dropped oldest records") //记录已保存,但丢弃了最早的记录
+)
+
+/*
+发送失败数据的存储
+
+超过最大重发次数的消息写入存储,连接池健康时按写入顺序取出重新发送,
+同一存储只有一个重发方,Iterate与Ack成对调用
+*/
+type FailoverStore interface {
+	Append(rec *SpoolRecord) error                         //保存一条发送失败的记录,已满时返回ErrFailoverStoreFull
+	Iterate(max int, fn func(rec *SpoolRecord) bool) error //按写入顺序遍历最多max条未确认的记录,fn返回false时停止
+	Ack(n int) error                                       //确认最近一次Iterate中前n条记录已处理,从存储中移除
+	Len() int64                                            //未确认的记录数
+}
+
+/*
+可隔离记录的存储
+
+连续重发失败超过WithReplayMaxAttempts次的记录交给Quarantine保存,随后由Ack从存储中移除;
+未实现该接口的存储保留这类记录继续重发,设置WithReplayDiscard(true)时移除
+*/
+type QuarantineStore interface {
+	Quarantine(rec *SpoolRecord, reason string) error
+}
+
+/*
+写入可取消的存储
+
+存储已满需要等待空间时,ctx结束后返回ErrFailoverStoreFull;
+连接池关闭时取消ctx,Close及关闭时写入存储的消息不会一直等待
+*/
+type ContextStore interface {
+	AppendContext(ctx context.Context, rec *SpoolRecord) error
+}
+
+/*
+内存存储,超过容量时拒绝写入,用于测试或不需要持久化的场景
+*/
+type MemoryStore struct {
+	lock        sync.Mutex
+	max         int
+	records     []*SpoolRecord
+	quarantined []*SpoolRecord
+}
+
+/*
+@param max int: 最大记录数,小于等于0时不限制
+*/
+func NewMemoryStore(max int) *MemoryStore {
+	return &MemoryStore{max: max}
+}
+
+func (m *MemoryStore) Append(rec *SpoolRecord) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.max > 0 && len(m.records) >= m.max {
+		return ErrFailoverStoreFull
+	}
+	m.records = append(m.records, rec)
+	return nil
+}
+
+func (m *MemoryStore) Iterate(max int, fn func(rec *SpoolRecord) bool) error {
+	m.lock.Lock()
+	n := len(m.records)
+	if max >= 0 && max < n {
+		n = max
+	}
+	records := make([]*SpoolRecord, n)
+	copy(records, m.records)
+	m.lock.Unlock()
+
+	for _, rec := range records {
+		if !fn(rec) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Ack(n int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if n > len(m.records) {
+		n = len(m.records)
+	}
+	if n > 0 {
+		m.records = append(m.records[:0:0], m.records[n:]...)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Len() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return int64(len(m.records))
+}
+
+func (m *MemoryStore) Quarantine(rec *SpoolRecord, reason string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	quarantined := *rec
+	quarantined.Reason = reason
+	m.quarantined = append(m.quarantined, &quarantined)
+	return nil
+}
+
+/*
+已隔离的记录
+*/
+func (m *MemoryStore) Quarantined() []*SpoolRecord {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]*SpoolRecord(nil), m.quarantined...)
+}
+
+/*
+空存储,丢弃所有发送失败的数据
+*/
+type NopStore struct{}
+
+func NewNopStore() *NopStore {
+	return &NopStore{}
+}
+
+func (NopStore) Append(rec *SpoolRecord) error { return nil }
+
+func (NopStore) Iterate(max int, fn func(rec *SpoolRecord) bool) error { return nil }
+
+func (NopStore) Ack(n int) error { return nil }
+
+func (NopStore) Len() int64 { return 0 }
+
+/*
+获取数据对应的存储
+
+设置了WithFailoverStore时所有数据使用该存储,
+否则按RabbitMqData.Localfile(为空时为WithSpoolDir)打开本地文件存储
+*/
+func (r *RabbitPool) getFailoverStore(data *RabbitMqData) (FailoverStore, error) {
+	if r.failoverStore != nil {
+		return r.failoverStore, nil
+	}
+	dir := r.spoolDir
+	if data != nil && data.Localfile != "" {
+		dir = data.Localfile
+	}
+	if dir == "" {
+		return nil, nil
+	}
+	r.spoolLock.Lock()
+	defer r.spoolLock.Unlock()
+	//Close关闭存储后不再打开,避免文件锁及刷盘协程泄漏
+	if r.spoolClosed {
+		return nil, os.ErrClosed
+	}
+	//旧版本的文件路径(localdata.txt)与去掉扩展名的目录使用同一个存储
+	key := spoolDirPath(dir)
+	if s, ok := r.spools[key]; ok {
+		if fs, ok := s.(*FileStore); ok && key != dir {
+			if err := fs.openLegacyFile(dir); err != nil {
+				rmqlog(fmt.Sprintf("导入旧版本本地文件失败: %s", err))
+			}
+		}
+		return s, nil
+	}
+	s, err := NewFileStore(dir, r.spoolOptions...)
+	if err != nil {
+		return nil, err
+	}
+	r.spools[key] = s
+	return s, nil
+}
+
+/*
+当前需要重发的存储
+*/
+func (r *RabbitPool) failoverStores() []FailoverStore {
+	if r.failoverStore != nil {
+		return []FailoverStore{r.failoverStore}
+	}
+	r.spoolLock.Lock()
+	defer r.spoolLock.Unlock()
+	stores := make([]FailoverStore, 0, len(r.spools))
+	for _, s := range r.spools {
+		stores = append(stores, s)
+	}
+	return stores
+}
+
+/*
+关闭连接池打开的本地文件存储,WithFailoverStore设置的存储由调用方管理
+*/
+func (r *RabbitPool) closeSpools() {
+	r.spoolLock.Lock()
+	defer r.spoolLock.Unlock()
+	r.spoolClosed = true
+	for dir, s := range r.spools {
+		if c, ok := s.(io.Closer); ok {
+			_ = c.Close()
+		}
+		delete(r.spools, dir)
+	}
+}
+
+/*
+发送失败的数据写入存储
+*/
+func (r *RabbitPool) spoolData(data *RabbitMqData, reason string, attempts int) error {
+	if data.replay {
+		return nil
+	}
+	store, err := r.getFailoverStore(data)
+	if err == nil && store == nil {
+		return nil
+	}
+	if err == nil {
+		rmqlog(fmt.Sprintf("消息发送失败,写入存储: %s", reason))
+		rec := &SpoolRecord{
+			Message:  data,
+			Reason:   reason,
+			Attempts: attempts,
+			Time:     time.Now(),
+		}
+		if cs, ok := store.(ContextStore); ok {
+			ctx, cancel := r.closeContext()
+			err = cs.AppendContext(ctx, rec)
+			cancel()
+		} else {
+			err = store.Append(rec)
+		}
+	}
+	if err != nil && !errors.Is(err, ErrFailoverStoreDropped) {
+		rmqlog(fmt.Sprintf("写入存储失败: %s", err))
+	}
+	return err
+}
+
+/*
+连接池关闭时取消的ctx
+*/
+func (r *RabbitPool) closeContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-r.closeChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+/*
+未发送的消息写入存储的结果,写入成功时返回nil
+*/
+func spoolResult(reason string, err error) *RabbitMqError {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrFailoverStoreDropped):
+		return NewRabbitMqError(RCODE_STORE_DROPPED_ERROR, reason+",已写入存储并丢弃最早的数据", err.Error())
+	case errors.Is(err, ErrFailoverStoreFull):
+		return NewRabbitMqError(RCODE_STORE_FULL_ERROR, reason+",存储已满", err.Error())
+	default:
+		return NewRabbitMqError(RCODE_STORE_ERROR, reason+",写入存储失败", err.Error())
+	}
+}
+
+/*
+存储重发
+
+连接池健康时按批取出存储中的数据重新发送,发送成功后确认,
+随连接池启动,Close时退出
+*/
+func (r *RabbitPool) runReplay() {
+	defer r.replayWait.Done()
+	if r.replayInterval <= 0 {
+		return
+	}
+	//启动时打开默认目录,重发上次运行遗留的数据
+	if _, err := r.getFailoverStore(nil); err != nil {
+		rmqlog(fmt.Sprintf("打开本地文件失败: %s", err))
+	}
+	ticker := time.NewTicker(r.replayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.closeChan:
+			return
+		case <-ticker.C:
+			if !r.IsHealthy() {
+				continue
+			}
+			//默认目录打开失败时重试
+			_, _ = r.getFailoverStore(nil)
+			for _, store := range r.failoverStores() {
+				r.replayStore(store)
+			}
+		}
+	}
+}
+
+func (r *RabbitPool) replayStore(store FailoverStore) {
+	var sent int
+	var failed *SpoolRecord
+	var reason string
+	ctx, cancel := r.closeContext()
+	defer cancel()
+	err := store.Iterate(r.replayBatch, func(rec *SpoolRecord) bool {
+		select {
+		case <-r.closeChan:
+			return false
+		default:
+		}
+		data := *rec.Message
+		if rec.Legacy {
+			if r.replayTarget == nil {
+				failed, reason = rec, "旧版本数据缺少交换机/队列/路由,请设置WithReplayTarget"
+				return false
+			}
+			data = *r.replayTarget
+			data.Data = rec.Message.Data
+			data.Body = nil
+		}
+		data.replay = true
+		//连接池关闭时停止,未发送的记录留在存储中
+		if r.limitWait(ctx, &data) != nil {
+			return false
+		}
+		if e := rPush(r, &data, 1); e != nil {
+			failed, reason = rec, fmt.Sprintf("%s %s", e.Error(), e.Detail)
+			return false
+		}
+		sent++
+		return true
+	})
+	if err != nil {
+		rmqlog(fmt.Sprintf("读取存储失败: %s", err))
+	}
+	acked := sent
+	if failed == nil {
+		delete(r.replayFailures, store)
+	} else if r.replayFailed(store, failed, reason, sent > 0) {
+		acked++
+	}
+	if acked == 0 {
+		return
+	}
+	if err = store.Ack(acked); err != nil {
+		rmqlog(fmt.Sprintf("确认重发数据失败: %s", err))
+		return
+	}
+	if sent > 0 {
+		rmqlog(fmt.Sprintf("存储数据重发成功: %d条", sent))
+	}
+}
+
+/*
+记录重发失败,连续失败达到replayAttempts次时隔离该记录,需要随发送成功的记录一起确认时返回true
+
+@param progressed bool 本次之前的记录已发送成功,失败的是新的第一条记录
+*/
+func (r *RabbitPool) replayFailed(store FailoverStore, rec *SpoolRecord, reason string, progressed bool) bool {
+	rmqlog(fmt.Sprintf("存储数据重发失败: %s", reason))
+	//连接断开导致的失败不计入记录的失败次数
+	if !r.IsHealthy() {
+		return false
+	}
+	attempts := 1
+	if !progressed {
+		attempts = r.replayFailures[store] + 1
+	}
+	if attempts < r.replayAttempts {
+		r.replayFailures[store] = attempts
+		return false
+	}
+	delete(r.replayFailures, store)
+	reason = fmt.Sprintf("重发失败%d次: %s", attempts, reason)
+	q, ok := store.(QuarantineStore)
+	if !ok {
+		//日志中不记录消息内容
+		if r.replayDiscard {
+			rmqlog(fmt.Sprintf("存储不支持隔离,丢弃记录: %s 交换机:%s 路由:%s", reason, rec.Message.ExchangeName, rec.Message.Route))
+			return true
+		}
+		rmqlog(fmt.Sprintf("存储不支持隔离,保留记录: %s 交换机:%s 路由:%s", reason, rec.Message.ExchangeName, rec.Message.Route))
+		return false
+	}
+	if err := q.Quarantine(rec, reason); err != nil {
+		rmqlog(fmt.Sprintf("隔离记录失败: %s", err))
+		return false
+	}
+	rmqlog(fmt.Sprintf("存储数据已隔离: %s", reason))
+	return true
+}
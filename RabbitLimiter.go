@@ -0,0 +1,263 @@
+package rabbitmqpool
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRateLimited = errors.New("publish rate limited")
+)
+
+/*
+超过限流时的处理方式
+*/
+const (
+	LIMIT_WAIT      = 1 //等待令牌,PushWithContext时受ctx控制
+	LIMIT_FAIL_FAST = 2 //直接返回RCODE_RATE_LIMITED_ERROR
+)
+
+const (
+	RATE_LIMIT_GLOBAL_KEY = "*" //全局限流在RateLimitStats中的名称
+)
+
+/*
+令牌桶
+*/
+type tokenBucket struct {
+	lock     sync.Mutex
+	rate     float64 //每秒产生的令牌数
+	burst    float64 //桶容量
+	tokens   float64
+	last     time.Time
+	allowed  uint64 //已放行次数
+	rejected uint64 //拒绝或等待超时次数
+	waiting  int64  //正在等待的调用数
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+/*
+取一个令牌,不足时返回需要等待的时间
+*/
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		b.allowed++
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+/*
+退回令牌,多个令牌桶中后面的桶拒绝时使用
+*/
+func (b *tokenBucket) refund() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+	b.allowed--
+}
+
+func (b *tokenBucket) reject() {
+	b.lock.Lock()
+	b.rejected++
+	b.lock.Unlock()
+}
+
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		ok, delay := b.take()
+		if ok {
+			return nil
+		}
+		b.lock.Lock()
+		b.waiting++
+		b.lock.Unlock()
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		b.lock.Lock()
+		b.waiting--
+		b.lock.Unlock()
+		if ctx.Err() != nil {
+			b.reject()
+			return ctx.Err()
+		}
+	}
+}
+
+type rateLimit struct {
+	exchangeName string
+	route        string
+	rate         float64
+	burst        int
+}
+
+/*
+连接池限流
+全局限流及按交换机/路由限流,一条消息需要从所有匹配的令牌桶中各取一个令牌
+*/
+type rateLimiter struct {
+	mode    int
+	global  *tokenBucket
+	buckets map[string]*tokenBucket //交换机/路由 -> 令牌桶,路由为空时限制整个交换机
+}
+
+func newRateLimiter(mode int, limits []rateLimit) *rateLimiter {
+	if len(limits) == 0 {
+		return nil
+	}
+	l := &rateLimiter{mode: mode, buckets: make(map[string]*tokenBucket)}
+	for _, limit := range limits {
+		b := newTokenBucket(limit.rate, limit.burst)
+		if limit.exchangeName == "" && limit.route == "" {
+			l.global = b
+			continue
+		}
+		l.buckets[rateLimitKey(limit.exchangeName, limit.route)] = b
+	}
+	return l
+}
+
+func rateLimitKey(exchangeName string, route string) string {
+	return exchangeName + "/" + route
+}
+
+func (l *rateLimiter) match(data *RabbitMqData) []*tokenBucket {
+	var buckets []*tokenBucket
+	if l.global != nil {
+		buckets = append(buckets, l.global)
+	}
+	if b, ok := l.buckets[rateLimitKey(data.ExchangeName, "")]; ok {
+		buckets = append(buckets, b)
+	}
+	if data.Route != "" {
+		if b, ok := l.buckets[rateLimitKey(data.ExchangeName, data.Route)]; ok {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+/*
+按限流规则等待或拒绝
+
+@param mode int 超过限流时的处理方式
+*/
+func (l *rateLimiter) acquire(ctx context.Context, data *RabbitMqData, mode int) error {
+	buckets := l.match(data)
+	for i, b := range buckets {
+		var err error
+		if mode == LIMIT_FAIL_FAST {
+			if ok, _ := b.take(); !ok {
+				b.reject()
+				err = ErrRateLimited
+			}
+		} else {
+			err = b.wait(ctx)
+		}
+		if err != nil {
+			for _, taken := range buckets[:i] {
+				taken.refund()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+发送前限流,未设置限流时直接返回
+*/
+func (r *RabbitPool) limit(ctx context.Context, data *RabbitMqData) *RabbitMqError {
+	if r.limiter == nil {
+		return nil
+	}
+	if err := r.limiter.acquire(ctx, data, r.limiter.mode); err != nil {
+		return NewRabbitMqError(RCODE_RATE_LIMITED_ERROR, "超过发送速率限制", err.Error())
+	}
+	return nil
+}
+
+/*
+存储重发及缓冲区发送前限流,不论限流方式都等待令牌,ctx结束时返回错误
+*/
+func (r *RabbitPool) limitWait(ctx context.Context, data *RabbitMqData) error {
+	if r.limiter == nil {
+		return nil
+	}
+	return r.limiter.acquire(ctx, data, LIMIT_WAIT)
+}
+
+/*
+限流状态
+*/
+type RateLimitStat struct {
+	Key      string  //RATE_LIMIT_GLOBAL_KEY或 交换机/路由
+	Rate     float64 //每秒令牌数
+	Burst    int     //桶容量
+	Tokens   float64 //当前可用令牌数
+	Allowed  uint64  //已放行次数
+	Rejected uint64  //拒绝或等待超时次数
+	Waiting  int64   //正在等待的调用数
+}
+
+func (b *tokenBucket) stat(key string) RateLimitStat {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(time.Now())
+	return RateLimitStat{
+		Key:      key,
+		Rate:     b.rate,
+		Burst:    int(b.burst),
+		Tokens:   b.tokens,
+		Allowed:  b.allowed,
+		Rejected: b.rejected,
+		Waiting:  b.waiting,
+	}
+}
+
+/*
+获取当前限流状态,用于监控
+*/
+func (r *RabbitPool) RateLimitStats() []RateLimitStat {
+	if r.limiter == nil {
+		return nil
+	}
+	var stats []RateLimitStat
+	if r.limiter.global != nil {
+		stats = append(stats, r.limiter.global.stat(RATE_LIMIT_GLOBAL_KEY))
+	}
+	keys := make([]string, 0, len(r.limiter.buckets))
+	for key := range r.limiter.buckets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		stats = append(stats, r.limiter.buckets[key].stat(key))
+	}
+	return stats
+}
@@ -3,6 +3,7 @@ package rabbitmqpool
 import (
 	"context"
 	rand2 "crypto/rand"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"hash/crc32"
@@ -20,7 +21,10 @@ import (
 )
 
 var (
-	ErrFooAckNil = errors.New("ack data nil")
+	ErrFooAckNil      = errors.New("ack data nil")
+	ErrPublishNack    = errors.New("publish nacked by broker")
+	ErrConfirmTimeout = errors.New("publish confirm timeout")
+	ErrConnectionDown = errors.New("connection down")
 )
 
 const (
@@ -31,6 +35,17 @@ const (
 
 	DEFAULT_MAX_PRODUCT_RETRY = 5 //生产者断线重连最大次数
 
+	DEFAULT_CONFIRM_TIMEOUT = 5 * time.Second //等待broker发布确认的超时时间
+
+	DEFAULT_SPOOL_DIR       = "localdata"      //发送失败数据保存的本地目录
+	DEFAULT_REPLAY_INTERVAL = 30 * time.Second //本地文件重发间隔
+	DEFAULT_REPLAY_BATCH    = 100              //每次重发的最大条数
+
+	DEFAULT_REPLAY_MAX_ATTEMPTS = 5 //单条记录连续重发失败的最大次数,超过后隔离
+
+	DEFAULT_ASYNC_WORKERS    = 4    //异步发送协程数
+	DEFAULT_ASYNC_QUEUE_SIZE = 1000 //异步发送队列长度
+
 	//轮循-连接池负载算法
 	LOAD_BALANCE_ROUND = 1
 )
@@ -62,6 +77,15 @@ const (
 	RCODE_PUSH_ERROR                        = 505 //消息推送失败
 	RCODE_CHANNEL_CREATE_ERROR              = 506 //信道创建失败
 	RCODE_RETRY_MAX_ERROR                   = 507 //超过最大重试次数
+	RCODE_PUSH_RETURN_ERROR                 = 508 //消息无法路由被broker退回
+	RCODE_STORE_FULL_ERROR                  = 509 //超过最大重试次数且存储已满,数据未保存
+	RCODE_STORE_DROPPED_ERROR               = 510 //超过最大重试次数,数据已保存并丢弃了最早的数据
+	RCODE_STORE_ERROR                       = 511 //超过最大重试次数且写入存储失败
+	RCODE_DECODE_ERROR                      = 512 //消息解码失败
+	RCODE_ENCODE_ERROR                      = 513 //消息编码失败
+	RCODE_ASYNC_QUEUE_ERROR                 = 514 //异步发送入队失败或连接池已关闭
+	RCODE_BUFFER_FULL_ERROR                 = 515 //连接断开且缓冲区已满,消息被丢弃
+	RCODE_RATE_LIMITED_ERROR                = 516 //超过发送速率限制
 
 )
 
@@ -73,6 +97,54 @@ type amqpConfig struct {
 	rabbitType int                //初始化类型,1代表生产者,2为消费者
 	vHost      string             //rabbitmq使用的vhost,默认为/
 	sLogger    *zap.SugaredLogger //日志
+
+	confirmMode    bool          //是否开启发布确认模式
+	confirmTimeout time.Duration //等待发布确认超时时间
+	returnSpool    bool          //被退回的消息是否写入本地文件
+
+	spoolDir       string        //发送失败数据保存的本地目录,RabbitMqData.Localfile为空时使用
+	replayInterval time.Duration //本地文件重发间隔,小于等于0时不重发
+	replayBatch    int           //每次重发的最大条数
+	replayAttempts int           //单条记录连续重发失败的最大次数
+	replayDiscard  bool          //存储不支持隔离时是否丢弃连续重发失败的记录
+	replayTarget   *RabbitMqData //重发目标交换机/队列/路由
+	failoverStore  FailoverStore //发送失败数据的存储,设置后替代本地文件
+	spoolOptions   []storeOption //本地文件存储容量/分段/已满策略
+
+	asyncWorkers   int //异步发送协程数
+	asyncQueueSize int //异步发送队列长度
+
+	bufferSize   int //连接断开时的缓冲区大小,为0时不缓冲
+	bufferPolicy int //缓冲区已满时的处理策略
+
+	rateLimits    []rateLimit //发送限流
+	rateLimitMode int         //超过限流时的处理方式
+
+	tls *tlsOptions //amqps连接配置,为nil时使用amqp
+
+	endpoints        []endpoint //集群其他节点
+	endpointStrategy int        //多节点连接策略
+
+	heartbeat    time.Duration //心跳间隔,未设置时为10秒
+	heartbeatSet bool
+	frameMax     int           //最大帧大小,为0时由服务端决定
+	channelMax   uint16        //最大信道数,为0时由服务端决定
+	dialTimeout  time.Duration //建立连接超时时间,为0时为30秒
+
+	locale           string     //连接locale,默认en_US
+	connectionName   string     //连接名称中的应用名,为空时使用程序文件名
+	clientProperties amqp.Table //客户端属性
+
+	credentials    CredentialsProvider //连接凭据,设置后替代password
+	authMechanisms []int               //SASL认证方式,为空时使用PLAIN
+
+	maxConnection      int32 //最大连接数,为0时使用默认值
+	consumeMaxChannel  int32 //消费者最大信道数,为0时使用默认值
+	pushMaxTime        int   //最大重发次数,为0时使用默认值
+	productMaxRetry    int32 //生产者断线重连最大次数,为0时使用默认值
+	consumeMaxRetry    int32 //消费者断线重连最大次数,为0时使用默认值
+	minRandomRetryTime int64 //随机重试时间,均为0时使用默认值
+	maxRandomRetryTime int64
 }
 
 type funcOption func(*amqpConfig)
@@ -98,6 +170,243 @@ func WithRabbitLogger(s *zap.SugaredLogger) funcOption {
 	}
 }
 
+/*
+开启发布确认(publisher confirms)模式
+
+信道进入confirm模式,每条消息等待broker ack后才视为发送成功,
+nack或超时的消息进入重试流程,超过最大重发次数后写入本地文件
+
+@param timeout time.Duration: 等待ack/nack的超时时间,小于等于0时使用默认值
+*/
+func WithPublisherConfirm(timeout time.Duration) funcOption {
+	return func(o *amqpConfig) {
+		o.confirmMode = true
+		if timeout > 0 {
+			o.confirmTimeout = timeout
+		}
+	}
+}
+
+/*
+mandatory消息被broker退回时是否写入本地文件
+*/
+func WithReturnSpool(b bool) funcOption {
+	return func(o *amqpConfig) {
+		o.returnSpool = b
+	}
+}
+
+/*
+设置发送失败数据保存的本地目录,RabbitMqData.Localfile为空时使用,
+连接池启动时重发该目录中遗留的数据
+*/
+func WithSpoolDir(dir string) funcOption {
+	return func(o *amqpConfig) {
+		o.spoolDir = dir
+	}
+}
+
+/*
+设置发送失败数据保存的本地文件,以.txt结尾时使用去掉扩展名的目录,文件中遗留的数据会被导入
+
+Deprecated: 使用WithSpoolDir
+*/
+func WithSpoolFile(filePath string) funcOption {
+	return WithSpoolDir(filePath)
+}
+
+/*
+设置本地文件重发间隔,小于等于0时关闭重发
+*/
+func WithReplayInterval(d time.Duration) funcOption {
+	return func(o *amqpConfig) {
+		o.replayInterval = d
+	}
+}
+
+/*
+设置每次重发的最大条数
+*/
+func WithReplayBatchSize(n int) funcOption {
+	return func(o *amqpConfig) {
+		if n > 0 {
+			o.replayBatch = n
+		}
+	}
+}
+
+/*
+设置单条记录连续重发失败的最大次数,超过后移入存储的隔离区(本地目录的quarantine文件),
+避免一条无法发送的记录阻塞之后的所有记录;连接断开导致的失败不计数
+*/
+func WithReplayMaxAttempts(n int) funcOption {
+	return func(o *amqpConfig) {
+		if n > 0 {
+			o.replayAttempts = n
+		}
+	}
+}
+
+/*
+存储未实现QuarantineStore时,是否丢弃连续重发失败WithReplayMaxAttempts次的记录
+默认保留在存储中继续重发,设置为true时确认移除该记录,数据丢失
+*/
+func WithReplayDiscard(b bool) funcOption {
+	return func(o *amqpConfig) {
+		o.replayDiscard = b
+	}
+}
+
+/*
+设置重发目标
+兼容旧版本只保存消息内容的本地文件,这类数据重发时发送到该交换机/队列/路由,未设置时跳过
+*/
+func WithReplayTarget(exChangeName string, exChangeType string, queueName string, route string) funcOption {
+	return func(o *amqpConfig) {
+		o.replayTarget = &RabbitMqData{
+			ExchangeName: exChangeName,
+			ExchangeType: exChangeType,
+			QueueName:    queueName,
+			Route:        route,
+		}
+	}
+}
+
+/*
+设置发送失败数据的存储,设置后替代本地文件存储,RabbitMqData.Localfile不再生效
+*/
+func WithFailoverStore(store FailoverStore) funcOption {
+	return func(o *amqpConfig) {
+		o.failoverStore = store
+	}
+}
+
+/*
+设置连接池打开的本地文件存储,如容量限制、分段大小、已满时的处理策略
+
+	WithSpoolOptions(WithStoreMaxBytes(1<<30), WithStoreOverflow(OVERFLOW_DROP_OLDEST, 0))
+*/
+func WithSpoolOptions(opts ...storeOption) funcOption {
+	return func(o *amqpConfig) {
+		o.spoolOptions = append(o.spoolOptions, opts...)
+	}
+}
+
+/*
+设置异步发送(PushAsync)的协程数及队列长度
+*/
+func WithAsyncWorkers(workers int) funcOption {
+	return func(o *amqpConfig) {
+		if workers > 0 {
+			o.asyncWorkers = workers
+		}
+	}
+}
+
+func WithAsyncQueueSize(size int) funcOption {
+	return func(o *amqpConfig) {
+		if size > 0 {
+			o.asyncQueueSize = size
+		}
+	}
+}
+
+/*
+设置连接断开时的缓冲区
+
+连接断开时Push/PushWithContext把消息放入内存缓冲区后返回nil,连接恢复后自动发送
+
+@param size int: 缓冲区大小,为0时不缓冲
+@param policy int: 缓冲区已满时的处理策略 BUFFER_BLOCK/BUFFER_DROP/BUFFER_SPOOL
+*/
+func WithOutageBuffer(size int, policy int) funcOption {
+	return func(o *amqpConfig) {
+		o.bufferSize = size
+		o.bufferPolicy = policy
+	}
+}
+
+/*
+设置连接池全局发送限流(令牌桶)
+
+@param rate float64: 每秒允许发送的消息数,小于等于0时不限流
+@param burst int: 允许的突发数量
+*/
+func WithRateLimit(rate float64, burst int) funcOption {
+	return WithExchangeRateLimit("", "", rate, burst)
+}
+
+/*
+按交换机/路由设置发送限流,route为空时限制整个交换机
+与全局限流同时生效
+*/
+func WithExchangeRateLimit(exChangeName string, route string, rate float64, burst int) funcOption {
+	return func(o *amqpConfig) {
+		if rate > 0 {
+			o.rateLimits = append(o.rateLimits, rateLimit{exchangeName: exChangeName, route: route, rate: rate, burst: burst})
+		}
+	}
+}
+
+/*
+设置超过限流时的处理方式 LIMIT_WAIT(默认)/LIMIT_FAIL_FAST
+*/
+func WithRateLimitMode(mode int) funcOption {
+	return func(o *amqpConfig) {
+		o.rateLimitMode = mode
+	}
+}
+
+/*
+设置最大连接数,效果同SetMaxConnection,在Connect建立连接前生效
+*/
+func WithMaxConnection(maxConnection int32) funcOption {
+	return func(o *amqpConfig) {
+		o.maxConnection = maxConnection
+	}
+}
+
+/*
+设置消费者最大信道数,效果同SetMaxConsumeChannel
+*/
+func WithMaxConsumeChannel(maxConsume int32) funcOption {
+	return func(o *amqpConfig) {
+		o.consumeMaxChannel = maxConsume
+	}
+}
+
+/*
+设置单条消息最大重发次数
+*/
+func WithPushMaxTime(n int) funcOption {
+	return func(o *amqpConfig) {
+		o.pushMaxTime = n
+	}
+}
+
+/*
+设置断线重连最大次数
+
+@param productRetry int32: 生产者重连次数
+@param consumeRetry int32: 消费者重连次数
+*/
+func WithMaxRetry(productRetry int32, consumeRetry int32) funcOption {
+	return func(o *amqpConfig) {
+		o.productMaxRetry = productRetry
+		o.consumeMaxRetry = consumeRetry
+	}
+}
+
+/*
+设置随机重试时间(毫秒),效果同SetRandomRetryTime
+*/
+func WithRandomRetryTime(min, max int64) funcOption {
+	return func(o *amqpConfig) {
+		o.minRandomRetryTime = min
+		o.maxRandomRetryTime = max
+	}
+}
+
 func NewAmqpConf(host string, port int, user string, password string, opts ...funcOption) *amqpConfig {
 	cnf := &amqpConfig{
 		host:       host,
@@ -106,6 +415,15 @@ func NewAmqpConf(host string, port int, user string, password string, opts ...fu
 		password:   password,
 		rabbitType: 1,
 		vHost:      "/",
+
+		confirmTimeout: DEFAULT_CONFIRM_TIMEOUT,
+		spoolDir:       DEFAULT_SPOOL_DIR,
+		replayInterval: DEFAULT_REPLAY_INTERVAL,
+		replayBatch:    DEFAULT_REPLAY_BATCH,
+		replayAttempts: DEFAULT_REPLAY_MAX_ATTEMPTS,
+		asyncWorkers:   DEFAULT_ASYNC_WORKERS,
+		asyncQueueSize: DEFAULT_ASYNC_QUEUE_SIZE,
+		rateLimitMode:  LIMIT_WAIT,
 	}
 	for _, opt := range opts {
 		opt(cnf)
@@ -187,11 +505,16 @@ func (r *retryClient) retryMessage(tryNum int32, pushD []byte) {
 		expirationTime = 5000
 	}
 
+	var contentType string
+	if r.data != nil {
+		contentType = r.data.ContentType
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	err := r.channel.PublishWithContext(ctx, r.deadExchangeName, r.deadRouteKey, false, false, amqp.Publishing{
-		ContentType:  "text/plain",
+		ContentType:  retryContentType(contentType),
 		Body:         pushD,
 		Expiration:   strconv.FormatInt(expirationTime, 10),
 		Headers:      r.header,
@@ -203,6 +526,16 @@ func (r *retryClient) retryMessage(tryNum int32, pushD []byte) {
 	}
 }
 
+/*
+重试消息保留原消息的content-type,便于按content-type解码
+*/
+func retryContentType(contentType string) string {
+	if contentType == "" {
+		return DEFAULT_CONTENT_TYPE
+	}
+	return contentType
+}
+
 /*
 错误返回
 */
@@ -231,6 +564,11 @@ type ConsumeReceive struct {
 	EventSuccess func(data []byte, header map[string]interface{}, retryClient RetryClientInterface,sLogger *zap.SugaredLogger) bool //成功事件回调
 	EventFail    func(int, error, []byte)                                                                //失败回调
 
+	//按消息content-type解码后回调,设置后代替EventSuccess;解码失败时回调EventFail(RCODE_DECODE_ERROR),
+	//设置了IsTry时进入重试队列,否则非自动确认的消息延迟DECODE_REQUEUE_DELAY后重新入队一次,再次失败时拒绝且不重新入队
+	EventDecoded func(v interface{}, delivery *amqp.Delivery, retryClient RetryClientInterface, sLogger *zap.SugaredLogger) bool
+	NewValue     func() interface{} //返回解码目标的指针,为空时解码为interface{}
+
 	IsTry     bool  //是否重试
 	MaxReTry  int32 //最大重式次数
 	IsAutoAck bool  //是否自动确认
@@ -252,8 +590,10 @@ func (r *RetryTool) push() {
 单个rabbitmq channel
 */
 type rChannel struct {
-	ch    *amqp.Channel
-	index int32
+	ch      *amqp.Channel
+	index   int32
+	confirm atomic.Bool    //信道是否处于confirm模式
+	returns *returnTracker //mandatory消息退回跟踪
 }
 
 type rConn struct {
@@ -275,7 +615,7 @@ type RabbitPool struct {
 	connections map[int][]*rConn    // rabbitmq连接池
 
 	channelLock    sync.RWMutex //信道池锁
-	connectionLock sync.Mutex   //连接锁
+	connectionLock sync.RWMutex //连接锁,保护connections及连接的替换
 
 	rabbitLoadBalance *RabbitLoadBalance //连接池负载模式(生产者)
 
@@ -299,7 +639,63 @@ type RabbitPool struct {
 	user        string //用户名
 	password    string //密码
 	virtualHost string // 默认为/
-	sLogger    *zap.SugaredLogger
+	sLogger     *zap.SugaredLogger
+
+	confirmMode    bool          //发布确认模式
+	confirmTimeout time.Duration //发布确认超时时间
+	returnSpool    bool          //退回消息写入本地文件
+
+	spoolDir       string                   //发送失败数据保存的本地目录
+	spools         map[string]FailoverStore //已打开的本地文件存储
+	spoolLock      sync.Mutex
+	spoolClosed    bool                  //Close后不再打开本地文件存储
+	failoverStore  FailoverStore         //自定义存储
+	spoolOptions   []storeOption         //本地文件存储选项
+	replayInterval time.Duration         //本地文件重发间隔
+	replayBatch    int                   //每次重发的最大条数
+	replayAttempts int                   //单条记录连续重发失败的最大次数
+	replayDiscard  bool                  //存储不支持隔离时丢弃连续重发失败的记录
+	replayFailures map[FailoverStore]int //存储中第一条记录连续重发失败的次数,只由重发协程访问
+	replayTarget   *RabbitMqData         //重发目标
+	replayWait     sync.WaitGroup        //Close时等待重发协程退出
+
+	asyncWorkers   int              //异步发送协程数
+	asyncQueueSize int              //异步发送队列长度
+	asyncQueue     chan *PushFuture //异步发送队列,首次PushAsync时创建
+	asyncOnce      sync.Once
+	asyncLock      sync.RWMutex
+	asyncClosed    bool
+	asyncWait      sync.WaitGroup
+
+	buffer       chan *RabbitMqData //连接断开时的缓冲区
+	bufferPolicy int                //缓冲区已满时的处理策略
+	bufferLock   sync.RWMutex
+	bufferClosed bool
+	bufferWait   sync.WaitGroup //Close时等待缓冲区发送协程退出
+
+	limiter *rateLimiter //发送限流
+
+	tlsConfig *tls.Config //amqps连接配置
+
+	endpoints        []endpoint //集群节点,第一个为host/port
+	endpointStrategy int        //多节点连接策略
+	endpointIndex    uint32     //ENDPOINT_ROUND_ROBIN下次连接的起始节点
+
+	heartbeat    time.Duration //心跳间隔
+	heartbeatSet bool
+	frameMax     int           //最大帧大小
+	channelMax   uint16        //最大信道数
+	dialTimeout  time.Duration //建立连接超时时间
+
+	locale           string     //连接locale
+	appName          string     //连接名称中的应用名
+	clientProperties amqp.Table //客户端属性
+
+	credentials    CredentialsProvider //连接凭据
+	authMechanisms []int               //SASL认证方式
+
+	closeChan chan struct{} //连接池关闭通知
+	closeOnce sync.Once
 }
 
 /*
@@ -332,6 +728,16 @@ func newRabbitPool(clientType int) *RabbitPool {
 		productMaxRetry:     DEFAULT_MAX_PRODUCT_RETRY,
 		pushCurrentRetry:    0,
 		connectStatus:       false,
+		confirmTimeout:      DEFAULT_CONFIRM_TIMEOUT,
+		spoolDir:            DEFAULT_SPOOL_DIR,
+		spools:              make(map[string]FailoverStore),
+		replayInterval:      DEFAULT_REPLAY_INTERVAL,
+		replayBatch:         DEFAULT_REPLAY_BATCH,
+		replayAttempts:      DEFAULT_REPLAY_MAX_ATTEMPTS,
+		replayFailures:      make(map[FailoverStore]int),
+		asyncWorkers:        DEFAULT_ASYNC_WORKERS,
+		asyncQueueSize:      DEFAULT_ASYNC_QUEUE_SIZE,
+		closeChan:           make(chan struct{}),
 		connections:         make(map[int][]*rConn, 2),
 		channelPool:         make(map[int64]*rChannel, 1),
 		rabbitLoadBalance:   NewRabbitLoadBalance(),
@@ -383,20 +789,92 @@ func (r *RabbitPool) GetPort() int {
 func (r *RabbitPool) Connect(amqpconfig *amqpConfig) error {
 	r.host = amqpconfig.host
 	r.port = amqpconfig.port
+	r.endpoints = append([]endpoint{{host: amqpconfig.host, port: amqpconfig.port}}, amqpconfig.endpoints...)
+	r.endpointStrategy = amqpconfig.endpointStrategy
+	r.heartbeat = amqpconfig.heartbeat
+	r.heartbeatSet = amqpconfig.heartbeatSet
+	r.frameMax = amqpconfig.frameMax
+	r.channelMax = amqpconfig.channelMax
+	r.dialTimeout = amqpconfig.dialTimeout
+	r.locale = amqpconfig.locale
+	r.appName = amqpconfig.connectionName
+	r.clientProperties = amqpconfig.clientProperties
 	r.user = amqpconfig.user
 	r.password = amqpconfig.password
+	r.credentials = amqpconfig.credentials
+	r.authMechanisms = amqpconfig.authMechanisms
 	r.virtualHost = amqpconfig.vHost
 	r.sLogger = amqpconfig.sLogger
+	r.confirmMode = amqpconfig.confirmMode
+	r.returnSpool = amqpconfig.returnSpool
+	r.spoolDir = amqpconfig.spoolDir
+	r.replayInterval = amqpconfig.replayInterval
+	r.replayTarget = amqpconfig.replayTarget
+	r.failoverStore = amqpconfig.failoverStore
+	r.spoolOptions = amqpconfig.spoolOptions
+	if amqpconfig.replayBatch > 0 {
+		r.replayBatch = amqpconfig.replayBatch
+	}
+	if amqpconfig.replayAttempts > 0 {
+		r.replayAttempts = amqpconfig.replayAttempts
+	}
+	r.replayDiscard = amqpconfig.replayDiscard
+	if amqpconfig.confirmTimeout > 0 {
+		r.confirmTimeout = amqpconfig.confirmTimeout
+	}
+	if amqpconfig.asyncWorkers > 0 {
+		r.asyncWorkers = amqpconfig.asyncWorkers
+	}
+	if amqpconfig.asyncQueueSize > 0 {
+		r.asyncQueueSize = amqpconfig.asyncQueueSize
+	}
+	if amqpconfig.maxConnection > 0 {
+		r.maxConnection = amqpconfig.maxConnection
+	}
+	if amqpconfig.consumeMaxChannel > 0 {
+		r.consumeMaxChannel = amqpconfig.consumeMaxChannel
+	}
+	if amqpconfig.pushMaxTime > 0 {
+		r.pushMaxTime = amqpconfig.pushMaxTime
+	}
+	if amqpconfig.productMaxRetry > 0 {
+		r.productMaxRetry = amqpconfig.productMaxRetry
+	}
+	if amqpconfig.consumeMaxRetry > 0 {
+		r.consumeMaxRetry = amqpconfig.consumeMaxRetry
+	}
+	if amqpconfig.minRandomRetryTime > 0 || amqpconfig.maxRandomRetryTime > 0 {
+		r.SetRandomRetryTime(amqpconfig.minRandomRetryTime, amqpconfig.maxRandomRetryTime)
+	}
+	r.limiter = newRateLimiter(amqpconfig.rateLimitMode, amqpconfig.rateLimits)
+	if amqpconfig.tls != nil {
+		tlsConfig, err := amqpconfig.tls.build()
+		if err != nil {
+			return err
+		}
+		r.tlsConfig = tlsConfig
+	}
+	if err := r.checkAuth(); err != nil {
+		return err
+	}
+	if amqpconfig.bufferSize > 0 && r.buffer == nil {
+		r.buffer = make(chan *RabbitMqData, amqpconfig.bufferSize)
+		r.bufferPolicy = amqpconfig.bufferPolicy
+	}
 	return r.initConnections(false)
 }
 
+/*
+连接池中是否有可用的连接
+检查全部连接,不改变负载均衡的位置
+*/
 func (r *RabbitPool) IsHealthy() bool {
-	rc := r.getConnection()
-	if rc == nil {
-		return false
-	}
-	if rc.conn != nil && !rc.conn.IsClosed() {
-		return true
+	r.connectionLock.RLock()
+	defer r.connectionLock.RUnlock()
+	for _, rc := range r.connections[r.clientType] {
+		if rc != nil && rc.conn != nil && !rc.conn.IsClosed() {
+			return true
+		}
 	}
 	return false
 }
@@ -409,7 +887,12 @@ func monitorPool(pool *RabbitPool) {
 		}
 	}()
 	for {
-		time.Sleep(30 * time.Second) // 每隔 30 秒检查一次
+		// 每隔 30 秒检查一次,连接池关闭后退出
+		select {
+		case <-pool.closeChan:
+			return
+		case <-time.After(30 * time.Second):
+		}
 		if !pool.IsHealthy() {
 			fmt.Println("Connection pool is unhealthy, reconnecting...")
 			err := pool.initConnections(false)
@@ -448,11 +931,24 @@ func (r *RabbitPool) Close() error {
 			fmt.Println("rabbitmq close error:", err)
 		}
 	}()
+	r.closeOnce.Do(func() {
+		close(r.closeChan)
+	})
+	r.stopAsync()
+	//等待缓冲区发送协程退出后,剩余消息写入存储
+	r.bufferWait.Wait()
+	r.closeBuffer()
+	//等待正在进行的重发确认后再关闭存储
+	r.replayWait.Wait()
+	r.closeSpools()
 	r.connectionLock.Lock()
 	defer r.connectionLock.Unlock()
 	for _, conn := range r.connections {
 		for _, channel := range conn {
-			channel.conn.Close()
+			//重连失败的连接为nil
+			if channel.conn != nil {
+				channel.conn.Close()
+			}
 		}
 	}
 	return nil
@@ -463,37 +959,50 @@ func (r *RabbitPool) Close() error {
 */
 
 func (r *RabbitPool) PushWithContext(ctx context.Context, data *RabbitMqData) *RabbitMqError {
+	if err := r.limit(ctx, data); err != nil {
+		return err
+	}
+	if r.shouldBuffer(data) {
+		return r.bufferPush(ctx, data)
+	}
 	return rPushWithCtx(ctx, r, data, 1)
 }
 
 func rPushWithCtx(ctx context.Context, pool *RabbitPool, data *RabbitMqData, sendTime int) *RabbitMqError {
 	if sendTime >= pool.pushMaxTime {
-		fmt.Println("//todel debug send failed! start write localdata to file...")
-		writeToLocalFile(data.Data, data.Localfile)
-		return NewRabbitMqError(RCODE_PUSH_MAX_ERROR, "重试超过最大次数", "")
+		return pool.pushFailed(data, sendTime, errors.New("重试超过最大次数"))
 	}
 
 	pool.channelLock.Lock()
-	defer pool.channelLock.Unlock()
-
 	conn := pool.getConnection()
-	conn, isTry := tryConn(pool, conn, 0, false, data.ExchangeName, data.ExchangeType, data.QueueName, data.Route)
-	rChannels, err := pool.getChannelQueueReset(conn, data.ExchangeName, data.ExchangeType, data.QueueName, data.Route, false, 0, isTry)
+	conn, isTry, err := tryConn(pool, conn, data.ExchangeName, data.ExchangeType, data.QueueName, data.Route)
+	if err != nil {
+		pool.channelLock.Unlock()
+		return pool.pushFailed(data, sendTime, err)
+	}
+	rChannels, err := pool.getPublishChannel(conn, data, data.Mandatory, isTry)
+	//channelLock只保护连接及信道池,发布和等待确认前释放:
+	//确认最长等待confirmTimeout,持锁会使所有生产者串行等待,且重试时的递归调用会再次加锁导致死锁。
+	//amqp091的Channel发布是并发安全的,confirm的delivery-tag由信道按发布顺序分配
+	pool.channelLock.Unlock()
 	if err != nil {
 		return NewRabbitMqError(RCODE_GET_CHANNEL_ERROR, "获取信道失败", err.Error())
 	}
 
-	err = rChannels.ch.PublishWithContext(ctx, data.ExchangeName, data.Route, false, false, amqp.Publishing{
-		ContentType:  "text/plain",
-		Body:         []byte(data.Data),
-		DeliveryMode: amqp.Persistent, //持久化到磁盘
-	})
+	err = pool.publish(ctx, rChannels, data)
 	if err != nil {
+		if errors.Is(err, ErrPublishReturned) {
+			return pool.pushReturned(data, err)
+		}
 		if ctx.Err() != nil {
 			// 如果 ctx 被取消或超时，直接返回
 			return NewRabbitMqError(RCODE_CONNECTION_ERROR, "上下文取消或超时", ctx.Err().Error())
 		}
-		// 如果消息发送失败, 重试发送
+		// 如果消息发送失败或未被确认, 重试发送
+		if sendTime+1 >= pool.pushMaxTime {
+			return pool.pushFailed(data, sendTime, err)
+		}
+		rmqlog(fmt.Sprintf("消息发送失败,2秒后重试: %s", err))
 		time.Sleep(time.Second * 2)
 		sendTime++
 		return rPushWithCtx(ctx, pool, data, sendTime)
@@ -503,6 +1012,12 @@ func rPushWithCtx(ctx context.Context, pool *RabbitPool, data *RabbitMqData, sen
 }
 
 func (r *RabbitPool) Push(data *RabbitMqData) *RabbitMqError {
+	if err := r.limit(context.Background(), data); err != nil {
+		return err
+	}
+	if r.shouldBuffer(data) {
+		return r.bufferPush(context.Background(), data)
+	}
 	return rPush(r, data, 1)
 }
 
@@ -513,6 +1028,8 @@ func (r *RabbitPool) Push(data *RabbitMqData) *RabbitMqError {
 */
 //TODO 连接建立失败时,返回异常,避免下标越界
 func (r *RabbitPool) getConnection() *rConn {
+	r.connectionLock.Lock()
+	defer r.connectionLock.Unlock()
 	r.connectionIndex = r.connectionIndex % int32(r.maxConnection)
 	if len(r.connections[r.clientType]) == 0 {
 		return nil
@@ -545,8 +1062,13 @@ func (r *RabbitPool) getConnection() *rConn {
 // todo channel关闭还是连接的状态下删除?
 func (r *RabbitPool) deleteChannel(conn *rConn, exChangeName string, exChangeType string, queueName string, route string) {
 	channelHashCode := channelHashCode(r.clientType, conn.index, exChangeName, exChangeType, queueName, route)
-	r.channelPool[channelHashCode].ch.Close()
-	if r.channelPool[channelHashCode].ch.IsClosed() {
+	//该消息的信道可能还未创建
+	rChannel, ok := r.channelPool[channelHashCode]
+	if !ok {
+		return
+	}
+	_ = rChannel.ch.Close()
+	if rChannel.ch.IsClosed() {
 		delete(r.channelPool, channelHashCode)
 	}
 }
@@ -556,13 +1078,35 @@ todo 需绑定队列
 */
 func (r *RabbitPool) getChannelQueueReset(conn *rConn, exChangeName string, exChangeType string, queueName string, route string, isDead bool, expireTime int, isReset bool) (*rChannel, error) {
 	channelHashCode := channelHashCode(r.clientType, conn.index, exChangeName, exChangeType, queueName, route)
-	if isReset {
-		if r.channelPool[channelHashCode].ch.IsClosed() {
-			delete(r.channelPool, channelHashCode)
-		}
+	return r.getChannel(channelHashCode, conn, exChangeName, exChangeType, queueName, route, isDead, r.confirmMode)
+}
+
+/*
+获取发送信道
+
+mandatory消息需要等待ack才能确定是否被退回,连接池未开启发布确认时使用单独的confirm信道,
+共享信道保持原来的模式
+
+@param confirm bool 是否需要confirm模式的信道
+*/
+func (r *RabbitPool) getPublishChannel(conn *rConn, data *RabbitMqData, confirm bool, isReset bool) (*rChannel, error) {
+	if !confirm || r.confirmMode {
+		return r.getChannelQueueReset(conn, data.ExchangeName, data.ExchangeType, data.QueueName, data.Route, false, 0, isReset)
 	}
+	channelHashCode := hashCode(fmt.Sprintf("confirm-%d-%d-%s-%s-%s-%s", r.clientType, conn.index, data.ExchangeName, data.ExchangeType, data.QueueName, data.Route))
+	return r.getChannel(channelHashCode, conn, data.ExchangeName, data.ExchangeType, data.QueueName, data.Route, false, true)
+}
+
+/*
+从信道池获取信道,不存在或已关闭时创建并声明交换机/队列/绑定
+*/
+func (r *RabbitPool) getChannel(channelHashCode int64, conn *rConn, exChangeName string, exChangeType string, queueName string, route string, isDead bool, confirm bool) (*rChannel, error) {
 	if channelQueues, ok := r.channelPool[channelHashCode]; ok {
-		return channelQueues, nil
+		//重连后旧连接上的信道已关闭,重新创建
+		if !channelQueues.ch.IsClosed() {
+			return channelQueues, nil
+		}
+		delete(r.channelPool, channelHashCode)
 	}
 	//初始化channel
 	rChannel, err := r.initChannels(conn, exChangeName, exChangeType, queueName, route)
@@ -574,6 +1118,14 @@ func (r *RabbitPool) getChannelQueueReset(conn *rConn, exChangeName string, exCh
 		return nil, err
 	}
 	rChannel.ch = channel.ch
+	if r.clientType == RABBITMQ_TYPE_PUBLISH {
+		rChannel.returns = newReturnTracker(rChannel.ch)
+		if confirm {
+			if err = enableConfirm(rChannel); err != nil {
+				return nil, err
+			}
+		}
+	}
 	r.channelPool[channelHashCode] = rChannel
 	return rChannel, nil
 
@@ -609,6 +1161,13 @@ func InitPool(amqpconfig *amqpConfig) (*RabbitPool, error) {
 		} else {
 			// 启动 goroutine 监测连接池健康状态
 			go monitorPool(instancePool)
+			// 启动本地文件重发
+			if instancePool.clientType == RABBITMQ_TYPE_PUBLISH {
+				instancePool.replayWait.Add(1)
+				go instancePool.runReplay()
+				instancePool.bufferWait.Add(1)
+				go instancePool.runBuffer()
+			}
 		}
 	}
 
@@ -619,19 +1178,41 @@ func InitPool(amqpconfig *amqpConfig) (*RabbitPool, error) {
 初始化连接池
 */
 func (r *RabbitPool) initConnections(isLock bool) error {
+	//建立连接时不持有connectionLock,建立的连接逐个加入连接池
+	r.connectionLock.Lock()
 	r.connections[r.clientType] = []*rConn{}
+	r.connectionLock.Unlock()
 	var i int32 = 0
 	for i = 0; i < r.maxConnection; i++ {
-		itemConnection, err := rConnect(r, isLock)
+		itemConnection, err := rConnect(r, isLock, i)
 		if err != nil {
 			return err
 		} else {
+			r.connectionLock.Lock()
+			//建立连接时连接池已关闭,Close不会再关闭该连接
+			select {
+			case <-r.closeChan:
+				r.connectionLock.Unlock()
+				_ = itemConnection.Close()
+				return errors.New("连接池已关闭")
+			default:
+			}
 			r.connections[r.clientType] = append(r.connections[r.clientType], &rConn{conn: itemConnection, index: i})
+			r.connectionLock.Unlock()
 		}
 	}
 	return nil
 }
 
+/*
+替换断开的连接,IsHealthy不持有channelLock,读写连接需要持有connectionLock
+*/
+func (r *RabbitPool) setConn(rc *rConn, conn *amqp.Connection) {
+	r.connectionLock.Lock()
+	rc.conn = conn
+	r.connectionLock.Unlock()
+}
+
 /*
 初始化信道池
 */
@@ -647,18 +1228,22 @@ func (r *RabbitPool) initChannels(conn *rConn, exChangeName string, exChangeType
 /*
 原rabbitmq连接
 */
-func rConnect(r *RabbitPool, islock bool) (*amqp.Connection, error) {
-	return connection(r.user, r.password, r.host, r.port, r.virtualHost)
+func rConnect(r *RabbitPool, islock bool, index int32) (*amqp.Connection, error) {
+	return r.dialEndpoints(index)
 }
 
-func connection(user string, password string, host string, port int, vHost string) (*amqp.Connection, error) {
-	connectionUrl := fmt.Sprintf("amqp://%s:%s@%s:%d%s", user, password, host, port, vHost)
-	//fmt.Println(connectionUrl)
-	client, err := amqp.Dial(connectionUrl)
-	if err != nil {
-		client = nil
+/*
+信道开启confirm模式
+*/
+func enableConfirm(rc *rChannel) error {
+	if rc.confirm.Load() {
+		return nil
+	}
+	if err := rc.ch.Confirm(false); err != nil {
+		return fmt.Errorf("MQ开启发布确认失败:%s", err)
 	}
-	return client, err
+	rc.confirm.Store(true)
+	return nil
 }
 
 /*
@@ -775,13 +1360,20 @@ func rConsume(pool *RabbitPool) {
 	}
 	// 创建一个协程监听任务
 	go func() {
-		// 在这里等待从 errorChanel 接收消息
-		<-pool.errorChanel
-		close(done) // 接收到消息后关闭退出通道
+		// 在这里等待从 errorChanel 接收消息,连接池关闭时不再重连
+		select {
+		case <-pool.errorChanel:
+			close(done) // 接收到消息后关闭退出通道
+		case <-pool.closeChan:
+		}
 	}()
 
 	// 等待退出通道关闭，同时执行 retryConsume
-	<-done
+	select {
+	case <-done:
+	case <-pool.closeChan:
+		return
+	}
 	statusLock.Lock()
 	status = true
 	statusLock.Unlock()
@@ -794,8 +1386,12 @@ func rConsume(pool *RabbitPool) {
 func retryConsume(pool *RabbitPool) {
 	rmqlog(fmt.Sprintf("2秒后开始重试:[%d]", pool.consumeCurrentRetry))
 	atomic.AddInt32(&pool.consumeCurrentRetry, 1)
-	time.Sleep(time.Second * 2)
-	_, err := rConnect(pool, true)
+	select {
+	case <-time.After(time.Second * 2):
+	case <-pool.closeChan:
+		return
+	}
+	_, err := rConnect(pool, true, 0)
 	if err != nil {
 		retryConsume(pool)
 	} else {
@@ -829,9 +1425,13 @@ func setConnectError(pool *RabbitPool, code int, message string) {
 	defer statusLock.Unlock()
 
 	if !status {
-		pool.errorChanel <- &amqp.Error{
+		//连接池关闭后不再有接收方
+		select {
+		case pool.errorChanel <- &amqp.Error{
 			Code:   code,
 			Reason: message,
+		}:
+		case <-pool.closeChan:
 		}
 	}
 	status = true
@@ -844,9 +1444,7 @@ func setConnectError(pool *RabbitPool, code int, message string) {
 func consumeTask(num int32, pool *RabbitPool, receive *ConsumeReceive) {
 	//获取请求连接
 	closeFlag := false
-	pool.connectionLock.Lock()
 	conn := pool.getConnection()
-	pool.connectionLock.Unlock()
 	//生成处理channel 根据最大channel数处理
 	channel, err := rCreateChannel(conn)
 	if err != nil {
@@ -922,17 +1520,23 @@ func consumeTask(num int32, pool *RabbitPool, receive *ConsumeReceive) {
 	notifyClose := channel.NotifyClose(closeChan)
 	for {
 		select {
-		case data := <-msgs:
+		case <-pool.closeChan:
+			return
+		case data, ok := <-msgs:
+			//信道关闭后由notifyClose处理
+			if !ok {
+				msgs = nil
+				continue
+			}
 			if receive.IsAutoAck { //如果是自动确认,否则需使用回调用 newRetryClient Ack
 				_ = data.Ack(true)
 			}
-			if receive.EventSuccess != nil {
+			if receive.EventSuccess != nil || receive.EventDecoded != nil {
 				retryClient := newRetryClient(channel, &data, data.Headers, deadExchangeName, deadQueueName, deadRouteKey, pool, receive)
-				var isOk bool
-				if pool.sLogger != nil{
-					isOk = receive.EventSuccess(data.Body, data.Headers, retryClient,pool.sLogger)
-				} else {
-					isOk = receive.EventSuccess(data.Body, data.Headers, retryClient,nil)
+				isOk, err := receive.dispatch(&data, retryClient, pool.sLogger)
+				if err != nil {
+					receive.decodeFailed(pool, &data, retryClient, err)
+					continue
 				}
 				if !isOk && receive.IsTry {
 					retryNum, ok := data.Headers["retry_nums"]
@@ -960,7 +1564,7 @@ func consumeTask(num int32, pool *RabbitPool, receive *ConsumeReceive) {
 							ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 							defer cancel()
 							err = channel.PublishWithContext(ctx, deadExchangeName, deadRouteKey, false, false, amqp.Publishing{
-								ContentType:  "text/plain",
+								ContentType:  retryContentType(data.ContentType),
 								Body:         data.Body,
 								Expiration:   strconv.FormatInt(expirationTime, 10),
 								Headers:      header,
@@ -971,7 +1575,16 @@ func consumeTask(num int32, pool *RabbitPool, receive *ConsumeReceive) {
 				}
 			}
 		//一但有错误直接返回 并关闭信道
-		case e := <-notifyClose:
+		case e, ok := <-notifyClose:
+			//正常关闭时没有错误
+			if !ok || e == nil {
+				select {
+				case <-pool.closeChan:
+					return
+				default:
+				}
+				e = &amqp.Error{Code: amqp.ChannelError, Reason: "channel closed"}
+			}
 			if receive.EventFail != nil {
 				receive.EventFail(RCODE_CONNECTION_ERROR, NewRabbitMqError(RCODE_CONNECTION_ERROR, fmt.Sprintf("消息处理中断: queue:%s\n", receive.QueueName), e.Error()), nil)
 			}
@@ -987,28 +1600,34 @@ func consumeTask(num int32, pool *RabbitPool, receive *ConsumeReceive) {
 /*
 获取生产者连接
 */
-func tryConn(pool *RabbitPool, rc *rConn, currentTry int, isRetry bool, exchangeName string, exchangeType string, queueName string, route string) (*rConn, bool) {
+func tryConn(pool *RabbitPool, rc *rConn, exchangeName string, exchangeType string, queueName string, route string) (*rConn, bool, error) {
 	tryStatus := false
-	if isRetry {
-		tryStatus = true
-		rmqlog("连接中断,2秒后开始重试")
-		atomic.AddInt32(&pool.productCurrentRetry, 1)
-		time.Sleep(time.Second * 2)
-	}
 	if rc == nil {
 		rc = pool.getConnection()
 	}
-	if rc.conn == nil || rc.conn.IsClosed() {
+	if rc == nil {
+		return nil, tryStatus, fmt.Errorf("%w: 连接池未初始化", ErrConnectionDown)
+	}
+	//最多重连productMaxRetry次,避免连接断开时一直持有channelLock
+	for i := int32(0); rc.conn == nil || rc.conn.IsClosed(); i++ {
+		if i >= pool.productMaxRetry {
+			return rc, tryStatus, fmt.Errorf("%w: 重连%d次失败", ErrConnectionDown, i)
+		}
+		if i > 0 {
+			tryStatus = true
+			rmqlog("连接中断,2秒后开始重试")
+			atomic.AddInt32(&pool.productCurrentRetry, 1)
+			time.Sleep(time.Second * 2)
+		}
 		rmqlog("开始尝试重试连接")
-		var err error
 		pool.deleteChannel(rc, exchangeName, exchangeType, queueName, route)
-		rc.conn, err = connection(pool.user, pool.password, pool.host, pool.port, pool.virtualHost)
+		conn, err := rConnect(pool, true, rc.index)
+		pool.setConn(rc, conn)
 		if err != nil {
 			rmqlog("重试连接失败")
-			tryConn(pool, rc, currentTry, true, exchangeName, exchangeType, queueName, route)
 		}
 	}
-	return rc, tryStatus
+	return rc, tryStatus, nil
 }
 
 /*
@@ -1016,30 +1635,40 @@ func tryConn(pool *RabbitPool, rc *rConn, currentTry int, isRetry bool, exchange
 */
 func rPush(pool *RabbitPool, data *RabbitMqData, sendTime int) *RabbitMqError {
 	if sendTime >= pool.pushMaxTime {
-		fmt.Println("//todel debug send failed! start write localdata to file...")
-		writeToLocalFile(data.Data, data.Localfile)
-		return NewRabbitMqError(RCODE_PUSH_MAX_ERROR, "重试超过最大次数", "")
+		return pool.pushFailed(data, sendTime, errors.New("重试超过最大次数"))
 	}
 	pool.channelLock.Lock()
 	conn := pool.getConnection()
-	conn, isTry := tryConn(pool, conn, 0, false, data.ExchangeName, data.ExchangeType, data.QueueName, data.Route)
-	rChannels, err := pool.getChannelQueueReset(conn, data.ExchangeName, data.ExchangeType, data.QueueName, data.Route, false, 0, isTry)
+	conn, isTry, err := tryConn(pool, conn, data.ExchangeName, data.ExchangeType, data.QueueName, data.Route)
+	if err != nil {
+		pool.channelLock.Unlock()
+		return pool.pushFailed(data, sendTime, err)
+	}
+	rChannels, err := pool.getPublishChannel(conn, data, data.Mandatory, isTry)
+	//与rPushWithCtx相同,发布前释放channelLock
 	pool.channelLock.Unlock()
 	if err != nil {
 		//fmt.Println(err)
 		return NewRabbitMqError(RCODE_GET_CHANNEL_ERROR, "获取信道失败", err.Error())
 	} else {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		timeout := 5 * time.Second
+		if rChannels.confirm.Load() {
+			timeout += pool.confirmTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
-		err = rChannels.ch.PublishWithContext(ctx, data.ExchangeName, data.Route, false, false, amqp.Publishing{
-			ContentType:  "text/plain",
-			Body:         []byte(data.Data),
-			DeliveryMode: amqp.Persistent, //持久化到磁盘
-		})
-		if err != nil { //如果消息发送失败, 重试发送
+		err = pool.publish(ctx, rChannels, data)
+		if errors.Is(err, ErrPublishReturned) { //无法路由的消息重试无意义
+			return pool.pushReturned(data, err)
+		}
+		if err != nil { //如果消息发送失败或未被确认, 重试发送
 			// todo 多次发送失败写入本地磁盘
 			//pool.channelLock.Unlock()
 			//如果没有发送成功,休息两秒重发
+			if sendTime+1 >= pool.pushMaxTime {
+				return pool.pushFailed(data, sendTime, err)
+			}
+			rmqlog(fmt.Sprintf("消息发送失败,2秒后重试: %s", err))
 			time.Sleep(time.Second * 2)
 			sendTime++
 			return rPush(pool, data, sendTime)
@@ -1049,6 +1678,126 @@ func rPush(pool *RabbitPool, data *RabbitMqData, sendTime int) *RabbitMqError {
 	return nil
 }
 
+/*
+发布消息
+
+信道处于confirm模式时等待broker确认,nack或超时均返回错误
+
+mandatory消息被退回时返回ErrPublishReturned
+*/
+func (r *RabbitPool) publish(ctx context.Context, rc *rChannel, data *RabbitMqData) error {
+	p, err := r.send(ctx, rc, data)
+	if err != nil {
+		return err
+	}
+	return r.settle(ctx, rc, p)
+}
+
+/*
+已发送等待确认的消息
+*/
+type pendingPublish struct {
+	dc     *amqp.DeferredConfirmation //信道不是confirm模式时为nil
+	waiter *returnWaiter              //mandatory消息的退回结果
+}
+
+/*
+发送消息,不等待确认,发送成功后需调用settle
+*/
+func (r *RabbitPool) send(ctx context.Context, rc *rChannel, data *RabbitMqData) (*pendingPublish, error) {
+	p := &pendingPublish{}
+	msg := data.publishing()
+	var err error
+	switch {
+	case data.Mandatory && rc.returns != nil:
+		p.waiter, p.dc, err = rc.returns.publish(msg, func(msg amqp.Publishing) (*amqp.DeferredConfirmation, error) {
+			return rc.ch.PublishWithDeferredConfirmWithContext(ctx, data.ExchangeName, data.Route, data.Mandatory, false, msg)
+		})
+	case rc.confirm.Load():
+		p.dc, err = rc.ch.PublishWithDeferredConfirmWithContext(ctx, data.ExchangeName, data.Route, data.Mandatory, false, msg)
+	default:
+		err = rc.ch.PublishWithContext(ctx, data.ExchangeName, data.Route, data.Mandatory, false, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+/*
+等待已发送消息的确认及退回结果
+*/
+func (r *RabbitPool) settle(ctx context.Context, rc *rChannel, p *pendingPublish) error {
+	if p.waiter != nil {
+		defer rc.returns.unregister(p.waiter)
+	}
+	if err := r.waitConfirm(ctx, p.dc); err != nil {
+		return err
+	}
+	if p.waiter != nil {
+		return rc.returns.returned(p.waiter)
+	}
+	return nil
+}
+
+/*
+超过最大重发次数,写入存储,错误码反映存储结果
+*/
+func (r *RabbitPool) pushFailed(data *RabbitMqData, attempts int, reason error) *RabbitMqError {
+	err := r.spoolData(data, reason.Error(), attempts)
+	switch {
+	case err == nil:
+		return NewRabbitMqError(RCODE_PUSH_MAX_ERROR, "重试超过最大次数", reason.Error())
+	case errors.Is(err, ErrFailoverStoreDropped):
+		return NewRabbitMqError(RCODE_STORE_DROPPED_ERROR, "重试超过最大次数,已写入存储并丢弃最早的数据", reason.Error())
+	case errors.Is(err, ErrFailoverStoreFull):
+		return NewRabbitMqError(RCODE_STORE_FULL_ERROR, "重试超过最大次数,存储已满", reason.Error())
+	default:
+		return NewRabbitMqError(RCODE_STORE_ERROR, "重试超过最大次数,写入存储失败", fmt.Sprintf("%s: %s", reason, err))
+	}
+}
+
+/*
+消息被退回
+*/
+func (r *RabbitPool) pushReturned(data *RabbitMqData, err error) *RabbitMqError {
+	if r.returnSpool {
+		_ = r.spoolData(data, err.Error(), 1)
+	}
+	return NewRabbitMqError(RCODE_PUSH_RETURN_ERROR, "消息无法路由被退回", err.Error())
+}
+
+/*
+等待broker对单条消息的ack/nack
+*/
+func (r *RabbitPool) waitConfirm(ctx context.Context, dc *amqp.DeferredConfirmation) error {
+	if dc == nil {
+		return nil
+	}
+	//已收到的确认不受ctx影响,批量发送时ctx可能在等待后面的消息时结束
+	select {
+	case <-dc.Done():
+		if !dc.Acked() {
+			return ErrPublishNack
+		}
+		return nil
+	default:
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, r.confirmTimeout)
+	defer cancel()
+	ack, err := dc.WaitContext(waitCtx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return ErrConfirmTimeout
+	}
+	if !ack {
+		return ErrPublishNack
+	}
+	return nil
+}
+
 /*
 信道hashcode
 */
@@ -0,0 +1,171 @@
+package rabbitmqpool
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	ErrPublishReturned = errors.New("publish returned by broker")
+)
+
+/*
+退回消息跟踪
+
+mandatory消息无法路由时,broker会在该消息的basic.ack之前发送basic.return,
+每个生产者信道有一个监听协程按到达顺序接收退回消息及发布确认,
+退回消息交给同一MessageId中第一条未确认的消息,
+发送方收到ack后与监听协程同步一次,即可确定消息是否被退回
+*/
+type returnTracker struct {
+	publishLock sync.Mutex //登记与发布保持同一顺序
+	lock        sync.Mutex
+	waiters     map[string][]*returnWaiter //MessageId -> 按发布顺序等待退回结果的消息
+	confirmed   uint64                     //已按顺序确认的最大delivery-tag,只由监听协程访问
+	sync        chan chan struct{}         //与监听协程同步
+	done        chan struct{}              //信道关闭后监听协程退出
+}
+
+/*
+等待退回结果的消息
+*/
+type returnWaiter struct {
+	id       string
+	dc       *amqp.DeferredConfirmation //发布完成前为nil
+	returned chan amqp.Return
+}
+
+func newReturnTracker(ch *amqp.Channel) *returnTracker {
+	t := &returnTracker{
+		waiters: make(map[string][]*returnWaiter),
+		sync:    make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// 使用无缓冲通道,amqp091按帧的顺序交给监听协程,
+	// 处理完退回消息之前不会处理之后的ack
+	returns := ch.NotifyReturn(make(chan amqp.Return))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation))
+	go t.listen(returns, confirms)
+	return t
+}
+
+func (t *returnTracker) listen(returns chan amqp.Return, confirms chan amqp.Confirmation) {
+	defer close(t.done)
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				return
+			}
+			t.dispatch(ret)
+		case c, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			t.confirmed = c.DeliveryTag
+		case s := <-t.sync:
+			close(s)
+		}
+	}
+}
+
+/*
+退回消息交给同一MessageId中第一条未确认的消息,之前的消息已被确认,不会再被退回
+*/
+func (t *returnTracker) dispatch(ret amqp.Return) {
+	t.lock.Lock()
+	var waiter *returnWaiter
+	for _, w := range t.waiters[ret.MessageId] {
+		if w.dc == nil || w.dc.DeliveryTag > t.confirmed {
+			waiter = w
+			break
+		}
+	}
+	t.lock.Unlock()
+	if waiter == nil {
+		rmqlog(fmt.Sprintf("消息被退回: exchange:%s route:%s reason:%d %s", ret.Exchange, ret.RoutingKey, ret.ReplyCode, ret.ReplyText))
+		return
+	}
+	select {
+	case waiter.returned <- ret:
+	default:
+	}
+}
+
+/*
+登记并发布一条mandatory消息,MessageId为空时生成一个用于关联退回结果
+*/
+func (t *returnTracker) publish(msg amqp.Publishing, fn func(msg amqp.Publishing) (*amqp.DeferredConfirmation, error)) (*returnWaiter, *amqp.DeferredConfirmation, error) {
+	if msg.MessageId == "" {
+		msg.MessageId = newMessageId()
+	}
+	w := &returnWaiter{id: msg.MessageId, returned: make(chan amqp.Return, 1)}
+	t.publishLock.Lock()
+	defer t.publishLock.Unlock()
+	t.lock.Lock()
+	t.waiters[w.id] = append(t.waiters[w.id], w)
+	t.lock.Unlock()
+	dc, err := fn(msg)
+	if err != nil {
+		t.unregister(w)
+		return nil, nil, err
+	}
+	t.lock.Lock()
+	w.dc = dc
+	t.lock.Unlock()
+	return w, dc, nil
+}
+
+func (t *returnTracker) unregister(w *returnWaiter) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	waiters := t.waiters[w.id]
+	for i, v := range waiters {
+		if v == w {
+			waiters = append(waiters[:i:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(t.waiters, w.id)
+	} else {
+		t.waiters[w.id] = waiters
+	}
+}
+
+/*
+等待监听协程处理完已接收的退回消息
+*/
+func (t *returnTracker) barrier() {
+	s := make(chan struct{})
+	select {
+	case t.sync <- s:
+		<-s
+	case <-t.done:
+	}
+}
+
+/*
+检查消息是否被退回,需在收到broker ack之后调用
+*/
+func (t *returnTracker) returned(w *returnWaiter) error {
+	t.barrier()
+	select {
+	case ret := <-w.returned:
+		return fmt.Errorf("%w: %d %s", ErrPublishReturned, ret.ReplyCode, ret.ReplyText)
+	default:
+		return nil
+	}
+}
+
+func newMessageId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
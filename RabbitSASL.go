@@ -0,0 +1,90 @@
+package rabbitmqpool
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+/*
+SASL认证方式
+*/
+const (
+	AUTH_PLAIN    = 1 //用户名密码,默认
+	AUTH_AMQPLAIN = 2 //用户名密码,AMQP表格式
+	AUTH_EXTERNAL = 3 //使用amqps客户端证书认证,不需要密码
+)
+
+var authMechanismNames = map[int]string{
+	AUTH_PLAIN:    "PLAIN",
+	AUTH_AMQPLAIN: "AMQPLAIN",
+	AUTH_EXTERNAL: "EXTERNAL",
+}
+
+/*
+设置SASL认证方式,按顺序使用第一个服务端支持的方式
+
+	WithAuthMechanism(AUTH_EXTERNAL)             //只使用证书认证
+	WithAuthMechanism(AUTH_EXTERNAL, AUTH_PLAIN) //服务端不支持EXTERNAL时使用密码
+
+AUTH_EXTERNAL需要同时设置WithTLSClientCert或在WithTLS中提供客户端证书,
+服务端根据证书的subject确定用户名
+*/
+func WithAuthMechanism(mechanisms ...int) funcOption {
+	return func(o *amqpConfig) {
+		o.authMechanisms = mechanisms
+	}
+}
+
+/*
+解析认证方式名称,不区分大小写
+*/
+func parseAuthMechanism(name string) (int, error) {
+	for mechanism, mechanismName := range authMechanismNames {
+		if strings.EqualFold(name, mechanismName) {
+			return mechanism, nil
+		}
+	}
+	return 0, fmt.Errorf("不支持的认证方式: %s", name)
+}
+
+/*
+检查认证方式,Connect时调用
+*/
+func (r *RabbitPool) checkAuth() error {
+	for _, mechanism := range r.authMechanisms {
+		if _, ok := authMechanismNames[mechanism]; !ok {
+			return fmt.Errorf("不支持的认证方式: %d", mechanism)
+		}
+		if mechanism != AUTH_EXTERNAL {
+			continue
+		}
+		if r.tlsConfig == nil {
+			return errors.New("EXTERNAL认证需要使用amqps连接")
+		}
+		if len(r.tlsConfig.Certificates) == 0 && r.tlsConfig.GetClientCertificate == nil {
+			return errors.New("EXTERNAL认证需要设置客户端证书")
+		}
+	}
+	return nil
+}
+
+/*
+本次连接的SASL认证,未设置认证方式时返回nil,使用PLAIN
+*/
+func (r *RabbitPool) saslAuth(user string, password string) []amqp.Authentication {
+	var sasl []amqp.Authentication
+	for _, mechanism := range r.authMechanisms {
+		switch mechanism {
+		case AUTH_PLAIN:
+			sasl = append(sasl, &amqp.PlainAuth{Username: user, Password: password})
+		case AUTH_AMQPLAIN:
+			sasl = append(sasl, &amqp.AMQPlainAuth{Username: user, Password: password})
+		case AUTH_EXTERNAL:
+			sasl = append(sasl, &amqp.ExternalAuth{})
+		}
+	}
+	return sasl
+}
@@ -0,0 +1,115 @@
+package rabbitmqpool
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	DEFAULT_TLS_MIN_VERSION = tls.VersionTLS12
+)
+
+/*
+amqps连接配置,证书在Connect时加载
+*/
+type tlsOptions struct {
+	caFile     string //CA证书,为空时使用系统证书
+	certFile   string //客户端证书,双向认证时使用
+	keyFile    string
+	serverName string      //校验服务端证书的域名,为空时使用host
+	minVersion uint16      //为0时使用config中的设置,都未设置时为DEFAULT_TLS_MIN_VERSION
+	config     *tls.Config //自定义配置,在此基础上应用以上设置
+}
+
+func (o *amqpConfig) tlsOpts() *tlsOptions {
+	if o.tls == nil {
+		o.tls = &tlsOptions{}
+	}
+	return o.tls
+}
+
+/*
+使用amqps连接,设置任意WithTLS*选项时开启
+
+@param config *tls.Config: 基础配置,可为nil
+*/
+func WithTLS(config *tls.Config) funcOption {
+	return func(o *amqpConfig) {
+		o.tlsOpts().config = config
+	}
+}
+
+/*
+设置校验服务端证书的CA证书文件(PEM),可包含多个证书
+*/
+func WithTLSCA(caFile string) funcOption {
+	return func(o *amqpConfig) {
+		o.tlsOpts().caFile = caFile
+	}
+}
+
+/*
+设置客户端证书及私钥文件(PEM),用于双向认证
+*/
+func WithTLSClientCert(certFile string, keyFile string) funcOption {
+	return func(o *amqpConfig) {
+		t := o.tlsOpts()
+		t.certFile = certFile
+		t.keyFile = keyFile
+	}
+}
+
+/*
+设置校验服务端证书的域名,连接地址为ip或与证书不一致时使用
+*/
+func WithTLSServerName(serverName string) funcOption {
+	return func(o *amqpConfig) {
+		o.tlsOpts().serverName = serverName
+	}
+}
+
+/*
+设置最低TLS版本,覆盖WithTLS配置中的MinVersion;都未设置时为tls.VersionTLS12
+*/
+func WithTLSMinVersion(version uint16) funcOption {
+	return func(o *amqpConfig) {
+		o.tlsOpts().minVersion = version
+	}
+}
+
+func (t *tlsOptions) build() (*tls.Config, error) {
+	config := &tls.Config{}
+	if t.config != nil {
+		config = t.config.Clone()
+	}
+	if t.minVersion > 0 {
+		config.MinVersion = t.minVersion
+	} else if config.MinVersion == 0 {
+		config.MinVersion = DEFAULT_TLS_MIN_VERSION
+	}
+	if t.serverName != "" {
+		config.ServerName = t.serverName
+	}
+	if t.caFile != "" {
+		pem, err := os.ReadFile(t.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取CA证书失败: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("CA证书中没有有效的PEM证书: " + t.caFile)
+		}
+		config.RootCAs = pool
+	}
+	if t.certFile != "" || t.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("加载客户端证书失败: %w", err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	return config, nil
+}
@@ -0,0 +1,113 @@
+package rabbitmqpool
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+)
+
+/*
+类型化生产者
+
+绑定一组交换机/队列/路由,发送时按ContentType编码T
+*/
+type Publisher[T any] struct {
+	pool         *RabbitPool
+	ExchangeName string //交换机名称
+	ExchangeType string //交换机类型
+	QueueName    string //队列名称
+	Route        string //路由
+	ContentType  string //编码类型,为空时使用json
+	Localfile    string //本地目录用于保存发送失败的数据,为空时使用连接池配置
+}
+
+func NewPublisher[T any](pool *RabbitPool, exChangeName string, exChangeType string, queueName string, route string) *Publisher[T] {
+	return &Publisher[T]{
+		pool:         pool,
+		ExchangeName: exChangeName,
+		ExchangeType: exChangeType,
+		QueueName:    queueName,
+		Route:        route,
+	}
+}
+
+/*
+编码为发送数据,可在发送前设置消息属性
+*/
+func (p *Publisher[T]) Data(v T) (*RabbitMqData, error) {
+	return GetRabbitMqDataFormatValue(p.ExchangeName, p.ExchangeType, p.QueueName, p.Route, v, p.ContentType, p.Localfile)
+}
+
+func (p *Publisher[T]) Push(v T) *RabbitMqError {
+	data, err := p.Data(v)
+	if err != nil {
+		return NewRabbitMqError(RCODE_ENCODE_ERROR, "消息编码失败", err.Error())
+	}
+	return p.pool.Push(data)
+}
+
+func (p *Publisher[T]) PushWithContext(ctx context.Context, v T) *RabbitMqError {
+	data, err := p.Data(v)
+	if err != nil {
+		return NewRabbitMqError(RCODE_ENCODE_ERROR, "消息编码失败", err.Error())
+	}
+	return p.pool.PushWithContext(ctx, data)
+}
+
+/*
+类型化消费者
+
+按消息content-type解码为T后回调Handler,delivery为原始消息
+*/
+type Consumer[T any] struct {
+	ExchangeName string                                                                                                //交换机
+	ExchangeType string                                                                                                //交换机类型
+	Route        string                                                                                                //路由
+	QueueName    string                                                                                                //队列名称
+	Handler      func(v T, delivery *amqp.Delivery, retryClient RetryClientInterface, sLogger *zap.SugaredLogger) bool //成功事件回调
+	EventFail    func(int, error, []byte)                                                                              //失败回调
+
+	IsTry     bool  //是否重试
+	MaxReTry  int32 //最大重式次数
+	IsAutoAck bool  //是否自动确认
+}
+
+func NewConsumer[T any](exChangeName string, exChangeType string, queueName string, route string, handler func(v T, delivery *amqp.Delivery, retryClient RetryClientInterface, sLogger *zap.SugaredLogger) bool) *Consumer[T] {
+	return &Consumer[T]{
+		ExchangeName: exChangeName,
+		ExchangeType: exChangeType,
+		QueueName:    queueName,
+		Route:        route,
+		Handler:      handler,
+	}
+}
+
+/*
+转换为消费者注册事件
+*/
+func (c *Consumer[T]) Receive() *ConsumeReceive {
+	return &ConsumeReceive{
+		ExchangeName: c.ExchangeName,
+		ExchangeType: c.ExchangeType,
+		Route:        c.Route,
+		QueueName:    c.QueueName,
+		EventFail:    c.EventFail,
+		IsTry:        c.IsTry,
+		MaxReTry:     c.MaxReTry,
+		IsAutoAck:    c.IsAutoAck,
+		NewValue: func() interface{} {
+			return new(T)
+		},
+		EventDecoded: func(v interface{}, delivery *amqp.Delivery, retryClient RetryClientInterface, sLogger *zap.SugaredLogger) bool {
+			return c.Handler(*v.(*T), delivery, retryClient, sLogger)
+		},
+	}
+}
+
+/*
+注册到消费者连接池
+*/
+func (c *Consumer[T]) Register(pool *RabbitPool) {
+	pool.RegisterConsumeReceive(c.Receive())
+}
@@ -5,6 +5,7 @@ go 1.21.0
 require (
 	github.com/rabbitmq/amqp091-go v1.10.0
 	go.uber.org/zap v1.27.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require go.uber.org/multierr v1.10.0 // indirect
@@ -1,115 +1,1278 @@
 package rabbitmqpool
 
 import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-// const filePath string = "data.txt"
+const (
+	SPOOL_SEGMENT_SUFFIX     = ".seg"         //分段文件后缀
+	SPOOL_CHECKPOINT_FILE    = "checkpoint"   //重发进度文件
+	SPOOL_LEGACY_SUFFIX      = ".legacy"      //迁移中的旧版本文件后缀
+	SPOOL_LEGACY_EXT         = ".txt"         //旧版本本地文件的扩展名
+	SPOOL_QUARANTINE_FILE    = "quarantine"   //损坏记录隔离文件
+	SPOOL_LOCK_SUFFIX        = ".lock"        //跨进程文件锁后缀,与本地目录同级
+	SPOOL_REPLAY_LOCK_SUFFIX = ".replay.lock" //重发权文件锁后缀,与本地目录同级
+	SPOOL_ENCRYPTED_PREFIX   = "enc:"         //加密记录前缀,之后为base64(nonce+密文)
+	SPOOL_FILE_MODE          = 0600           //本地文件权限
+	SPOOL_DIR_MODE           = 0700           //本地目录权限
+	DEFAULT_SPOOL_SEG_BYTES  = 64 << 20       //单个分段文件最大字节数
 
-var mutex sync.Mutex
+	DEFAULT_SPOOL_SYNC_INTERVAL = time.Second            //FSYNC_INTERVAL默认刷盘间隔
+	DEFAULT_SPOOL_LOCK_TIMEOUT  = 5 * time.Second        //默认等待其他进程释放文件锁的时间
+	SPOOL_BLOCK_POLL_INTERVAL   = 100 * time.Millisecond //OVERFLOW_BLOCK检查其他进程是否腾出空间的间隔
+)
+
+/*
+写入刷盘策略
+*/
+const (
+	FSYNC_ALWAYS   = 1 //每次写入后刷盘
+	FSYNC_INTERVAL = 2 //按间隔刷盘
+	FSYNC_NEVER    = 3 //由操作系统决定
+)
+
+/*
+存储已满时的处理策略
+*/
+const (
+	OVERFLOW_REJECT      = 1 //拒绝新数据
+	OVERFLOW_DROP_OLDEST = 2 //丢弃最早的数据
+	OVERFLOW_BLOCK       = 3 //阻塞调用方直到重发腾出空间
+)
+
+var (
+	ErrSpoolRecordCorrupt = errors.New("spool record corrupt")
+	ErrSpoolLocked        = errors.New("spool locked by another process")
+	ErrSpoolDecrypt       = errors.New("spool record decrypt failed") //未设置密钥或密钥错误
+)
+
+/*
+发送失败的记录
+
+本地文件中每条记录为一行: 8位十六进制crc32校验和 + 空格 + json,
+json保存完整的发送数据及失败信息,数据中的换行会被转义,
+设置了加密密钥时json加密后以SPOOL_ENCRYPTED_PREFIX开头
+*/
+type SpoolRecord struct {
+	Message  *RabbitMqData `json:"message"`
+	Reason   string        `json:"reason"`           //失败原因
+	Attempts int           `json:"attempts"`         //已尝试发送次数
+	Time     time.Time     `json:"time"`             //写入时间
+	Legacy   bool          `json:"legacy,omitempty"` //旧版本只保存消息内容的记录,交换机/队列/路由为空
+}
+
+func encodeSpoolRecord(rec *SpoolRecord, aead cipher.AEAD) (string, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	if aead != nil {
+		nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(b)+aead.Overhead())
+		if _, err = rand.Read(nonce); err != nil {
+			return "", err
+		}
+		b = []byte(SPOOL_ENCRYPTED_PREFIX + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, b, nil)))
+	}
+	return fmt.Sprintf("%08x %s", crc32.ChecksumIEEE(b), b), nil
+}
+
+/*
+解析本地文件中的一行,校验和不一致或无法解析时返回ErrSpoolRecordCorrupt,
+加密记录无法解密时返回ErrSpoolDecrypt
 
-func writeToLocalFile(data string, filePath string) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+没有校验和的行兼容旧版本格式
+*/
+func decodeSpoolRecord(line string, aead cipher.AEAD) (*SpoolRecord, error) {
+	if len(line) > 9 && line[8] == ' ' {
+		sum, err := strconv.ParseUint(line[:8], 16, 32)
+		if err == nil {
+			payload := []byte(line[9:])
+			if uint32(sum) != crc32.ChecksumIEEE(payload) {
+				return nil, ErrSpoolRecordCorrupt
+			}
+			if payload, err = decryptSpoolPayload(payload, aead); err != nil {
+				return nil, err
+			}
+			rec := &SpoolRecord{}
+			if err = json.Unmarshal(payload, rec); err != nil || rec.Message == nil {
+				return nil, ErrSpoolRecordCorrupt
+			}
+			return rec, nil
+		}
+	}
+	return decodeLegacyRecord(line), nil
+}
 
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+func decryptSpoolPayload(payload []byte, aead cipher.AEAD) ([]byte, error) {
+	if !strings.HasPrefix(string(payload), SPOOL_ENCRYPTED_PREFIX) {
+		return payload, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(payload[len(SPOOL_ENCRYPTED_PREFIX):]))
 	if err != nil {
-		fmt.Println("Failed open file: ", filePath)
+		return nil, ErrSpoolRecordCorrupt
+	}
+	//校验和已通过,解密失败说明密钥不对,保留记录等待正确的密钥
+	if aead == nil || len(sealed) < aead.NonceSize() {
+		return nil, ErrSpoolDecrypt
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrSpoolDecrypt
+	}
+	return plain, nil
+}
+
+/*
+旧版本格式: 不带校验和的json记录,或只保存消息内容
+*/
+func decodeLegacyRecord(line string) *SpoolRecord {
+	if strings.HasPrefix(line, "{") {
+		rec := &SpoolRecord{}
+		if err := json.Unmarshal([]byte(line), rec); err == nil && rec.Message != nil {
+			return rec
+		}
+	}
+	return &SpoolRecord{Message: &RabbitMqData{Data: line}, Legacy: true}
+}
+
+/*
+本地文件读取位置
+*/
+type spoolPos struct {
+	segment uint64 //分段编号
+	offset  int64  //分段内偏移
+}
+
+func (p spoolPos) less(o spoolPos) bool {
+	if p.segment != o.segment {
+		return p.segment < o.segment
+	}
+	return p.offset < o.offset
+}
+
+/*
+本地文件存储,默认的FailoverStore
+
+目录下按编号保存分段文件,写入只追加到最后一个分段,超过大小后切换新分段;
+重发进度(分段编号+偏移)保存在checkpoint文件中,
+分段中的数据全部重发后删除该分段
+
+可限制未重发数据的总字节数/记录数,超过后按overflow策略处理
+*/
+type FileStore struct {
+	dir          string
+	legacyFile   string        //以.txt结尾打开时的旧版本文件路径
+	segBytes     int64         //单个分段最大字节数
+	maxBytes     int64         //未重发数据最大字节数,小于等于0时不限制
+	maxEntries   int64         //未重发数据最大记录数,小于等于0时不限制
+	overflow     int           //存储已满时的处理策略
+	blockTimeout time.Duration //OVERFLOW_BLOCK等待超时时间,小于等于0时一直等待
+	syncPolicy   int           //写入刷盘策略
+	syncInterval time.Duration //FSYNC_INTERVAL刷盘间隔
+	lockTimeout  time.Duration //等待其他进程释放文件锁的时间,小于等于0时不等待
+	lockFile     *os.File      //跨进程文件锁,每次读写时短暂持有
+	replayFile   *os.File      //重发权文件锁,获取后持有到Close
+	key          []byte        //加密密钥
+	aead         cipher.AEAD
+
+	lock        sync.Mutex
+	writeSeg    uint64        //当前写入分段
+	writeFile   *os.File      //当前写入分段文件
+	writeSize   int64         //当前写入分段大小
+	readPos     spoolPos      //重发进度
+	checkpoint  spoolPos      //最近一次读取或保存的checkpoint,用于发现其他进程推进的进度
+	iterEnds    []spoolPos    //最近一次Iterate中读取的每行的结束位置
+	iterLines   []int         //最近一次Iterate中交给调用方的每条记录对应的行数
+	quarantined spoolPos      //已隔离的损坏记录位置,避免重复隔离
+	dirty       bool          //有未刷盘的写入
+	count       int64         //未重发的记录数
+	bytes       int64         //未重发的字节数
+	space       chan struct{} //重发腾出空间时关闭,唤醒阻塞的写入
+	closed      bool
+	done        chan struct{} //关闭时停止定时刷盘
+}
+
+type storeOption func(*FileStore)
+
+/*
+设置未重发数据的最大字节数
+*/
+func WithStoreMaxBytes(n int64) storeOption {
+	return func(s *FileStore) {
+		s.maxBytes = n
+	}
+}
+
+/*
+设置未重发数据的最大记录数
+*/
+func WithStoreMaxEntries(n int64) storeOption {
+	return func(s *FileStore) {
+		s.maxEntries = n
+	}
+}
+
+/*
+设置单个分段文件的最大字节数,超过后切换新分段
+*/
+func WithStoreSegmentBytes(n int64) storeOption {
+	return func(s *FileStore) {
+		if n > 0 {
+			s.segBytes = n
+		}
+	}
+}
+
+/*
+设置写入刷盘策略
+
+@param policy int: FSYNC_ALWAYS/FSYNC_INTERVAL/FSYNC_NEVER
+@param interval time.Duration: FSYNC_INTERVAL时的刷盘间隔,小于等于0时使用默认值
+*/
+func WithStoreSync(policy int, interval time.Duration) storeOption {
+	return func(s *FileStore) {
+		s.syncPolicy = policy
+		if interval > 0 {
+			s.syncInterval = interval
+		}
+	}
+}
+
+/*
+设置等待其他进程释放文件锁的时间,每次写入/重发只短暂持有锁,超时后返回ErrSpoolLocked
+
+@param timeout time.Duration: 默认5秒,小于等于0时不等待
+*/
+func WithStoreLockTimeout(timeout time.Duration) storeOption {
+	return func(s *FileStore) {
+		s.lockTimeout = timeout
+	}
+}
+
+/*
+设置加密密钥,记录使用AES-GCM加密后写入,重发时自动解密
+未加密的记录仍可读取,已加密的记录需要相同的密钥
+
+@param key []byte: 16/24/32字节,分别对应AES-128/192/256
+*/
+func WithStoreEncryptionKey(key []byte) storeOption {
+	return func(s *FileStore) {
+		s.key = key
+	}
+}
+
+/*
+设置存储已满时的处理策略
+
+@param policy int: OVERFLOW_REJECT/OVERFLOW_DROP_OLDEST/OVERFLOW_BLOCK
+@param blockTimeout time.Duration: OVERFLOW_BLOCK时的最长等待时间,小于等于0时一直等待
+*/
+func WithStoreOverflow(policy int, blockTimeout time.Duration) storeOption {
+	return func(s *FileStore) {
+		s.overflow = policy
+		s.blockTimeout = blockTimeout
+	}
+}
+
+/*
+打开本地文件存储目录,不存在时创建
+旧版本单文件格式会被迁移到目录中;
+以.txt结尾的旧版本文件路径使用去掉扩展名的目录,例如localdata.txt使用localdata目录
+*/
+func NewFileStore(dir string, opts ...storeOption) (*FileStore, error) {
+	s := &FileStore{
+		dir:          spoolDirPath(dir),
+		segBytes:     DEFAULT_SPOOL_SEG_BYTES,
+		overflow:     OVERFLOW_REJECT,
+		syncPolicy:   FSYNC_INTERVAL,
+		syncInterval: DEFAULT_SPOOL_SYNC_INTERVAL,
+		lockTimeout:  DEFAULT_SPOOL_LOCK_TIMEOUT,
+		space:        make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.dir != dir {
+		s.legacyFile = dir
+	}
+	if s.key != nil {
+		block, err := aes.NewCipher(s.key)
+		if err != nil {
+			return nil, fmt.Errorf("spool encryption key: %w", err)
+		}
+		if s.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	lockFile, err := openSpoolLock(s.dir + SPOOL_LOCK_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	s.lockFile = lockFile
+	if err = s.lockSpool(); err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	err = s.open()
+	s.release()
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	if s.syncPolicy == FSYNC_INTERVAL {
+		go s.syncLoop()
+	}
+	return s, nil
+}
+
+func (s *FileStore) open() error {
+	if err := migrateLegacyFile(s.dir, s.dir); err != nil {
 		return err
 	}
-	defer file.Close()
-	_, err = file.WriteString(data + "\n")
+	if err := os.MkdirAll(s.dir, SPOOL_DIR_MODE); err != nil {
+		return err
+	}
+	//已存在的目录也收紧权限,目录中的数据可能包含敏感信息
+	if err := os.Chmod(s.dir, SPOOL_DIR_MODE); err != nil {
+		return err
+	}
+	if err := s.reload(); err != nil {
+		if s.writeFile != nil {
+			s.writeFile.Close()
+		}
+		return err
+	}
+	if err := s.importLegacy(s.legacyFile); err != nil {
+		s.writeFile.Close()
+		return err
+	}
+	return nil
+}
+
+/*
+重新读取本地目录的分段及重发进度,统计未重发的记录
+*/
+func (s *FileStore) reload() error {
+	segments, err := s.segments()
 	if err != nil {
-		fmt.Println("Write to file failed: ", err)
 		return err
 	}
-	// encoder := json.NewEncoder(file)
-	// if err := encoder.Encode(data); err != nil {
-	// 	return err
-	// }
+	if s.checkpoint, err = s.loadCheckpoint(); err != nil {
+		return err
+	}
+	s.readPos = s.checkpoint
+	if len(segments) == 0 {
+		segments = []uint64{1}
+	}
+	if s.readPos.segment < segments[0] {
+		s.readPos = spoolPos{segment: segments[0]}
+	}
+	writeSeg := segments[len(segments)-1]
+	if s.readPos.segment > writeSeg {
+		writeSeg = s.readPos.segment
+	}
+	if s.writeFile != nil {
+		if s.syncPolicy != FSYNC_NEVER {
+			_ = s.sync()
+		}
+		s.writeFile.Close()
+		s.writeFile = nil
+		s.dirty = false
+	}
+	if err = s.openWriteSegment(writeSeg); err != nil {
+		return err
+	}
+	if err = s.terminateTornLine(); err != nil {
+		return err
+	}
+	if s.count, err = s.countFrom(s.readPos); err != nil {
+		return err
+	}
+	s.bytes = 0
+	for _, segment := range segments {
+		if segment >= s.readPos.segment {
+			s.bytes += s.segmentSize(segment)
+		}
+	}
+	s.bytes -= s.readPos.offset
+	if s.bytes < 0 {
+		s.bytes = 0
+	}
+	s.wakeBlocked()
 	return nil
 }
 
-func TmpMain() {
-	filePath := "localdata.txt"
-	readAndSendData(filePath)
+/*
+同步其他进程对本地目录的修改,获取文件锁后调用
+
+同一分段内追加的记录及推进的重发进度只统计变化的部分,
+其他进程切换或删除了分段时重新读取
+*/
+func (s *FileStore) refresh() error {
+	if s.writeFile == nil {
+		return s.reload()
+	}
+	checkpoint, err := s.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(s.segmentPath(s.writeSeg))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s.reload()
+		}
+		return err
+	}
+	if _, err = os.Stat(s.segmentPath(s.writeSeg + 1)); err == nil || info.Size() < s.writeSize {
+		return s.reload()
+	}
+	if info.Size() > s.writeSize {
+		//其他进程追加的记录
+		from := spoolPos{segment: s.writeSeg, offset: s.writeSize}
+		s.writeSize = info.Size()
+		if err = s.terminateTornLine(); err != nil {
+			return err
+		}
+		added, err := s.countFrom(from)
+		if err != nil {
+			return err
+		}
+		s.count += added
+		s.bytes += s.writeSize - from.offset
+	}
+	if checkpoint == s.checkpoint {
+		return nil
+	}
+	//其他进程重发或丢弃了记录
+	if checkpoint.segment != s.readPos.segment || checkpoint.offset < s.readPos.offset {
+		return s.reload()
+	}
+	var removed int64
+	err = s.scan(s.readPos, -1, func(line string, end spoolPos) bool {
+		if checkpoint.less(end) {
+			return false
+		}
+		removed++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	s.count -= removed
+	if s.count < 0 {
+		s.count = 0
+	}
+	s.bytes -= checkpoint.offset - s.readPos.offset
+	if s.bytes < 0 {
+		s.bytes = 0
+	}
+	s.readPos = checkpoint
+	s.checkpoint = checkpoint
+	s.wakeBlocked()
+	return nil
 }
 
-func readAndSendData(filePath string) {
+/*
+唤醒等待空间的写入
+*/
+func (s *FileStore) wakeBlocked() {
+	close(s.space)
+	s.space = make(chan struct{})
+}
+
+/*
+上次异常退出时最后一行可能只写了一半,补上换行使其成为独立的一行,
+读取时校验失败被隔离,不影响之后追加的记录
+*/
+func (s *FileStore) terminateTornLine() error {
+	if s.writeSize == 0 {
+		return nil
+	}
+	file, err := os.Open(s.segmentPath(s.writeSeg))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	last := make([]byte, 1)
+	if _, err = file.ReadAt(last, s.writeSize-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	rmqlog(fmt.Sprintf("本地文件最后一条记录不完整: %s", s.segmentPath(s.writeSeg)))
+	n, err := s.writeFile.WriteString("\n")
+	s.writeSize += int64(n)
+	return err
+}
+
+/*
+FSYNC_INTERVAL定时刷盘
+*/
+func (s *FileStore) syncLoop() {
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			if !s.closed {
+				if err := s.sync(); err != nil {
+					rmqlog(fmt.Sprintf("本地文件刷盘失败: %s", err))
+				}
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+func (s *FileStore) sync() error {
+	if !s.dirty {
+		return nil
+	}
+	s.dirty = false
+	return s.writeFile.Sync()
+}
+
+var errSpoolLockBusy = errors.New("spool lock busy")
+
+/*
+打开跨进程文件锁,不存在时创建
+*/
+func openSpoolLock(path string) (*os.File, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, SPOOL_FILE_MODE)
+}
+
+/*
+获取跨进程文件锁,其他进程或FileStore持有时等待lockTimeout,超时返回ErrSpoolLocked
+
+写入、重发、丢弃等每次操作只在期间持有,多个进程可以同时写入同一本地目录
+*/
+func (s *FileStore) lockSpool() error {
+	deadline := time.Now().Add(s.lockTimeout)
+	delay := time.Millisecond
 	for {
-		time.Sleep(30 * time.Second)
-		mutex.Lock()
-		data, err := os.ReadFile(filePath)
+		err := tryLockFile(s.lockFile)
+		if err != errSpoolLockBusy {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%w: %s", ErrSpoolLocked, s.lockFile.Name())
+		}
+		time.Sleep(delay)
+		if delay < 50*time.Millisecond {
+			delay *= 2
+		}
+	}
+}
+
+/*
+获取跨进程文件锁并同步其他进程的修改,之后需调用release
+*/
+func (s *FileStore) acquire() error {
+	if err := s.lockSpool(); err != nil {
+		return err
+	}
+	if err := s.refresh(); err != nil {
+		s.release()
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) release() {
+	if err := unlockFile(s.lockFile); err != nil {
+		rmqlog(fmt.Sprintf("释放本地文件锁失败: %s", err))
+	}
+}
+
+/*
+获取重发权,同一本地目录同时只由一个FileStore重发,获取后持有到Close
+
+其他FileStore的Iterate不返回记录,持有方关闭或进程退出后由下一次Iterate接管;
+文件内容为持有方进程号,便于排查
+*/
+func (s *FileStore) takeReplay() (bool, error) {
+	if s.replayFile != nil {
+		return true, nil
+	}
+	file, err := openSpoolLock(s.dir + SPOOL_REPLAY_LOCK_SUFFIX)
+	if err != nil {
+		return false, err
+	}
+	if err = tryLockFile(file); err != nil {
+		file.Close()
+		if err == errSpoolLockBusy {
+			return false, nil
+		}
+		return false, err
+	}
+	if err = file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		releaseSpoolLock(file)
+		return false, err
+	}
+	s.replayFile = file
+	return true, nil
+}
+
+func releaseSpoolLock(file *os.File) {
+	_ = unlockFile(file)
+	_ = file.Close()
+}
+
+/*
+本地文件路径对应的目录,以.txt结尾的旧版本文件路径去掉扩展名
+*/
+func spoolDirPath(path string) string {
+	if ext := filepath.Ext(path); strings.EqualFold(ext, SPOOL_LEGACY_EXT) {
+		return strings.TrimSuffix(path, ext)
+	}
+	return path
+}
+
+/*
+旧版本单文件改名,等待导入到目录中
+已有等待导入的文件时保留,导入后下次打开再迁移
+*/
+func migrateLegacyFile(path string, dir string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+	if _, err = os.Stat(dir + SPOOL_LEGACY_SUFFIX); err == nil {
+		return nil
+	}
+	return os.Rename(path, dir+SPOOL_LEGACY_SUFFIX)
+}
+
+/*
+导入等待导入的旧版本文件,再迁移并导入path
+*/
+func (s *FileStore) importLegacy(path string) error {
+	if err := s.importLegacyFile(s.dir + SPOOL_LEGACY_SUFFIX); err != nil {
+		return err
+	}
+	if path == "" {
+		return nil
+	}
+	if err := migrateLegacyFile(path, s.dir); err != nil {
+		return err
+	}
+	return s.importLegacyFile(s.dir + SPOOL_LEGACY_SUFFIX)
+}
+
+/*
+导入旧版本文件中遗留的数据,目录已由其他路径打开时使用
+*/
+func (s *FileStore) openLegacyFile(path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	return s.importLegacy(path)
+}
+
+func (s *FileStore) importLegacyFile(path string) error {
+	input, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, line := range strings.Split(string(input), "\n") {
+		if line == "" {
+			continue
+		}
+		line, err = encodeSpoolRecord(decodeLegacyRecord(line), s.aead)
+		if err != nil {
+			return err
+		}
+		if err = s.append(line); err != nil {
+			return err
+		}
+	}
+	if err = s.writeFile.Sync(); err != nil {
+		return err
+	}
+	rmqlog(fmt.Sprintf("旧版本本地文件已导入: %s", path))
+	return os.Remove(path)
+}
+
+func (s *FileStore) segmentPath(segment uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", segment, SPOOL_SEGMENT_SUFFIX))
+}
+
+/*
+按编号升序列出分段
+*/
+func (s *FileStore) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, SPOOL_SEGMENT_SUFFIX) {
+			continue
+		}
+		segment, err := strconv.ParseUint(strings.TrimSuffix(name, SPOOL_SEGMENT_SUFFIX), 10, 64)
 		if err != nil {
-			mutex.Unlock()
-			fmt.Println("Error reading file:", err)
 			continue
 		}
-		mutex.Unlock()
-
-		lines := splitLines(string(data))
-		for _, line := range lines {
-			// Simulate sending data (replace with actual sending logic)
-			success := sendData(line)
-			if success {
-				removeLineFromFile(line, filePath)
-				fmt.Println("Data sent successfully and line removed:", line)
-			} else {
-				fmt.Println("Failed to send data:", line)
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (s *FileStore) segmentSize(segment uint64) int64 {
+	if segment == s.writeSeg && s.writeFile != nil {
+		return s.writeSize
+	}
+	info, err := os.Stat(s.segmentPath(segment))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+/*
+两个位置之间的字节数,from需不小于重发进度
+*/
+func (s *FileStore) distance(from, to spoolPos) int64 {
+	if from.segment == to.segment {
+		return to.offset - from.offset
+	}
+	n := s.segmentSize(from.segment) - from.offset
+	for segment := from.segment + 1; segment < to.segment; segment++ {
+		n += s.segmentSize(segment)
+	}
+	return n + to.offset
+}
+
+func (s *FileStore) openWriteSegment(segment uint64) error {
+	file, err := os.OpenFile(s.segmentPath(segment), os.O_APPEND|os.O_CREATE|os.O_WRONLY, SPOOL_FILE_MODE)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.writeSeg = segment
+	s.writeFile = file
+	s.writeSize = info.Size()
+	return nil
+}
+
+func (s *FileStore) loadCheckpoint() (spoolPos, error) {
+	var pos spoolPos
+	input, err := os.ReadFile(filepath.Join(s.dir, SPOOL_CHECKPOINT_FILE))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return pos, nil
+		}
+		return pos, err
+	}
+	if _, err = fmt.Sscanf(string(input), "%d %d", &pos.segment, &pos.offset); err != nil {
+		return pos, fmt.Errorf("解析checkpoint失败: %s", err)
+	}
+	return pos, nil
+}
+
+/*
+保存重发进度,先写临时文件再改名保证原子性
+*/
+func (s *FileStore) saveCheckpoint(pos spoolPos) error {
+	path := filepath.Join(s.dir, SPOOL_CHECKPOINT_FILE)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, SPOOL_FILE_MODE)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, "%d %d\n", pos.segment, pos.offset)
+	if err == nil && s.syncPolicy != FSYNC_NEVER {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+/*
+统计pos之后的记录数
+*/
+func (s *FileStore) countFrom(pos spoolPos) (int64, error) {
+	var count int64
+	err := s.scan(pos, -1, func(line string, end spoolPos) bool {
+		count++
+		return true
+	})
+	return count, err
+}
+
+/*
+从pos开始按顺序读取完整的记录,fn返回false或读取max条后停止,max小于0时不限制
+
+@param fn 记录内容及该记录结束位置
+*/
+func (s *FileStore) scan(pos spoolPos, max int, fn func(line string, end spoolPos) bool) error {
+	var n int
+	for segment := pos.segment; segment <= s.writeSeg; segment++ {
+		offset := int64(0)
+		if segment == pos.segment {
+			offset = pos.offset
+		}
+		file, err := os.Open(s.segmentPath(segment))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
 			}
+			return err
+		}
+		if _, err = file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return err
+		}
+		reader := bufio.NewReader(file)
+		for {
+			if max >= 0 && n >= max {
+				file.Close()
+				return nil
+			}
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				file.Close()
+				//最后一行不完整时不读取
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return err
+			}
+			offset += int64(len(line))
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				continue
+			}
+			n++
+			if !fn(line, spoolPos{segment: segment, offset: offset}) {
+				file.Close()
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+/*
+追加一条记录,写入期间持有跨进程文件锁
+
+存储已满时按overflow策略处理:
+OVERFLOW_REJECT返回ErrFailoverStoreFull;
+OVERFLOW_DROP_OLDEST丢弃最早的记录后写入,返回ErrFailoverStoreDropped;
+OVERFLOW_BLOCK等待重发腾出空间,等待时不持有文件锁,超时返回ErrFailoverStoreFull
+*/
+func (s *FileStore) Append(rec *SpoolRecord) error {
+	return s.AppendContext(context.Background(), rec)
+}
+
+/*
+追加一条记录,OVERFLOW_BLOCK等待空间时ctx结束返回ErrFailoverStoreFull
+*/
+func (s *FileStore) AppendContext(ctx context.Context, rec *SpoolRecord) error {
+	line, err := encodeSpoolRecord(rec, s.aead)
+	if err != nil {
+		return err
+	}
+	size := int64(len(line)) + 1
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.maxBytes > 0 && size > s.maxBytes {
+		return ErrFailoverStoreFull
+	}
+	var timeout <-chan time.Time
+	if s.overflow == OVERFLOW_BLOCK && s.blockTimeout > 0 {
+		timer := time.NewTimer(s.blockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		if s.closed {
+			return os.ErrClosed
+		}
+		added, err := s.tryAppend(line, size)
+		if added || err != nil {
+			return err
+		}
+		//其他进程的重发不会唤醒本进程,定时重新检查
+		space := s.space
+		s.lock.Unlock()
+		poll := time.NewTimer(SPOOL_BLOCK_POLL_INTERVAL)
+		select {
+		case <-space:
+		case <-poll.C:
+		case <-timeout:
+			poll.Stop()
+			s.lock.Lock()
+			return ErrFailoverStoreFull
+		case <-ctx.Done():
+			poll.Stop()
+			s.lock.Lock()
+			return ErrFailoverStoreFull
 		}
+		poll.Stop()
+		s.lock.Lock()
 	}
 }
 
-func splitLines(input string) []string {
-	return strings.Split(input, "\n")
+/*
+持有跨进程文件锁写入一条记录,存储已满且需要等待时返回false
+*/
+func (s *FileStore) tryAppend(line string, size int64) (bool, error) {
+	if err := s.acquire(); err != nil {
+		return false, err
+	}
+	defer s.release()
+	if s.fits(size, 0, 0) {
+		return true, s.append(line)
+	}
+	switch s.overflow {
+	case OVERFLOW_DROP_OLDEST:
+		if err := s.dropOldest(size); err != nil {
+			return false, err
+		}
+		if err := s.append(line); err != nil {
+			return false, err
+		}
+		return true, ErrFailoverStoreDropped
+	case OVERFLOW_BLOCK:
+		return false, nil
+	default:
+		return false, ErrFailoverStoreFull
+	}
 }
 
-func sendData(data string) bool {
-	// Replace this with actual sending logic
-	// If sending is successful, return true; otherwise, return false
-	fmt.Println("data content is ", data)
+/*
+丢弃freedEntries条/freedBytes字节后能否写入size字节
+*/
+func (s *FileStore) fits(size int64, freedEntries int64, freedBytes int64) bool {
+	if s.maxEntries > 0 && s.count-freedEntries+1 > s.maxEntries {
+		return false
+	}
+	if s.maxBytes > 0 && s.bytes-freedBytes+size > s.maxBytes {
+		return false
+	}
 	return true
 }
 
-func removeLineFromFile(lineToRemove string, filePath string) {
-	mutex.Lock()
-	defer mutex.Unlock()
+/*
+从重发进度开始丢弃最早的记录,直到能写入size字节
+*/
+func (s *FileStore) dropOldest(size int64) error {
+	var dropped int64
+	var end spoolPos
+	err := s.scan(s.readPos, -1, func(line string, pos spoolPos) bool {
+		dropped++
+		end = pos
+		return !s.fits(size, dropped, s.distance(s.readPos, pos))
+	})
+	if err != nil {
+		return err
+	}
+	if dropped == 0 {
+		return ErrFailoverStoreFull
+	}
+	rmqlog(fmt.Sprintf("存储已满,丢弃最早的%d条记录: %s", dropped, s.dir))
+	return s.advance(end, dropped)
+}
 
-	input, err := os.ReadFile(filePath)
+func (s *FileStore) append(line string) error {
+	if s.writeSize > 0 && s.writeSize+int64(len(line))+1 > s.segBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.writeFile.WriteString(line + "\n")
+	s.writeSize += int64(n)
+	s.bytes += int64(n)
 	if err != nil {
-		fmt.Println("Error reading file for removing line:", err)
-		return
+		return err
+	}
+	s.count++
+	s.dirty = true
+	if s.syncPolicy == FSYNC_ALWAYS {
+		return s.sync()
+	}
+	return nil
+}
+
+/*
+切换到新的分段
+*/
+func (s *FileStore) rotate() error {
+	if s.syncPolicy != FSYNC_NEVER {
+		if err := s.sync(); err != nil {
+			return err
+		}
+	}
+	if err := s.writeFile.Close(); err != nil {
+		return err
 	}
+	return s.openWriteSegment(s.writeSeg + 1)
+}
+
+/*
+从重发进度开始按顺序遍历最多max条记录,fn返回false时停止
+读取时持有锁,调用fn时不持有锁,遍历期间不影响写入;
+同一本地目录只有获取重发权的FileStore返回记录,见takeReplay
 
-	lines := splitLines(string(input))
-	var output []string
-	for _, line := range lines {
-		if line != lineToRemove {
-			output = append(output, line)
+校验失败的记录不交给fn,写入quarantine文件隔离,
+无法解密的记录停止遍历并返回ErrSpoolDecrypt
+*/
+func (s *FileStore) Iterate(max int, fn func(rec *SpoolRecord) bool) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return os.ErrClosed
+	}
+	owner, err := s.takeReplay()
+	if err != nil || !owner {
+		s.lock.Unlock()
+		return err
+	}
+	if err = s.acquire(); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	var records []*SpoolRecord
+	var ends []spoolPos
+	var lines []int
+	var decryptErr error
+	err = s.scan(s.readPos, max, func(line string, end spoolPos) bool {
+		rec, derr := decodeSpoolRecord(line, s.aead)
+		if errors.Is(derr, ErrSpoolDecrypt) {
+			decryptErr = derr
+			return false
+		}
+		ends = append(ends, end)
+		if derr != nil {
+			s.quarantine(line, end)
+			return true
 		}
+		records = append(records, rec)
+		lines = append(lines, len(ends))
+		return true
+	})
+	//读取的全部是损坏记录时直接跳过
+	if err == nil && len(records) == 0 && len(ends) > 0 {
+		err = s.advance(ends[len(ends)-1], int64(len(ends)))
+	}
+	if err == nil {
+		err = decryptErr
 	}
+	s.iterEnds = ends
+	s.iterLines = lines
+	s.release()
+	s.lock.Unlock()
 
-	err = os.WriteFile(filePath, []byte(strings.Join(output, "\n")), 0644)
+	for _, rec := range records {
+		if !fn(rec) {
+			break
+		}
+	}
+	return err
+}
+
+/*
+隔离损坏的记录
+*/
+func (s *FileStore) quarantine(line string, end spoolPos) {
+	if !s.quarantined.less(end) {
+		return
+	}
+	s.quarantined = end
+	rmqlog(fmt.Sprintf("本地文件记录校验失败,已隔离: %s 分段%d 偏移%d", s.dir, end.segment, end.offset))
+	if err := s.appendQuarantine(line); err != nil {
+		rmqlog(fmt.Sprintf("写入隔离文件失败: %s", err))
+	}
+}
+
+/*
+多次重发失败的记录写入隔离文件,随后由Ack从存储中移除
+*/
+func (s *FileStore) Quarantine(rec *SpoolRecord, reason string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+	quarantined := *rec
+	quarantined.Reason = reason
+	line, err := encodeSpoolRecord(&quarantined, s.aead)
 	if err != nil {
-		fmt.Println("Error writing file after removing line:", err)
+		return err
 	}
+	return s.appendQuarantine(line)
 }
 
-// func testmain() {
-// 	// Example usage
-// 	err := writeToLocalFile("Data to be written")
-// 	if err != nil {
-// 		log.Fatal("Error writing to file:", err)
-// 	}
+func (s *FileStore) appendQuarantine(line string) error {
+	file, err := os.OpenFile(filepath.Join(s.dir, SPOOL_QUARANTINE_FILE), os.O_APPEND|os.O_CREATE|os.O_WRONLY, SPOOL_FILE_MODE)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.WriteString(line + "\n"); err != nil {
+		return err
+	}
+	return file.Sync()
+}
 
-// 	// Start reading and sending data from the file in the background
-// 	go readAndSendData()
+/*
+确认最近一次Iterate中前n条记录已处理,推进重发进度并删除已全部重发的分段
+*/
+func (s *FileStore) Ack(n int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+	if n <= 0 {
+		return nil
+	}
+	if n > len(s.iterLines) {
+		return fmt.Errorf("ack %d条记录超过最近一次遍历的%d条", n, len(s.iterLines))
+	}
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	//前n条记录及其间隔离的记录一起确认,遍历后被丢弃的记录不再计数
+	ends := s.iterEnds[:s.iterLines[n-1]]
+	var acked int64
+	for _, end := range ends {
+		if s.readPos.less(end) {
+			acked++
+		}
+	}
+	s.iterEnds = nil
+	s.iterLines = nil
+	return s.advance(ends[len(ends)-1], acked)
+}
 
-// 	// Keep the program running
-// 	select {}
-// }
+/*
+重发进度推进到pos,n为跳过的记录数,删除已全部重发的分段并唤醒阻塞的写入
+*/
+func (s *FileStore) advance(pos spoolPos, n int64) error {
+	if !s.readPos.less(pos) {
+		return nil
+	}
+	freed := s.distance(s.readPos, pos)
+	//当前分段读完且已有新分段时,进度移到下一分段
+	if pos.segment < s.writeSeg && pos.offset >= s.segmentSize(pos.segment) {
+		pos = spoolPos{segment: pos.segment + 1}
+	}
+	if err := s.saveCheckpoint(pos); err != nil {
+		return err
+	}
+	s.checkpoint = pos
+	for segment := s.readPos.segment; segment < pos.segment; segment++ {
+		if err := os.Remove(s.segmentPath(segment)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			rmqlog(fmt.Sprintf("删除本地文件分段失败: %s", err))
+		}
+	}
+	s.readPos = pos
+	s.count -= n
+	if s.count < 0 {
+		s.count = 0
+	}
+	s.bytes -= freed
+	if s.bytes < 0 {
+		s.bytes = 0
+	}
+	s.wakeBlocked()
+	return nil
+}
+
+/*
+未重发的记录数,包含其他进程写入的记录
+*/
+func (s *FileStore) Len() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed && s.acquire() == nil {
+		s.release()
+	}
+	return s.count
+}
+
+/*
+关闭当前写入分段,关闭后不能再读写
+*/
+func (s *FileStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.space)
+	close(s.done)
+	if s.syncPolicy != FSYNC_NEVER {
+		_ = s.sync()
+	}
+	err := s.writeFile.Close()
+	if s.replayFile != nil {
+		releaseSpoolLock(s.replayFile)
+	}
+	_ = s.lockFile.Close()
+	return err
+}
+
+/*
+Deprecated: 本地文件重发已由连接池管理,见 WithReplayInterval
+*/
+func TmpMain() {
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package rabbitmqpool
+
+import (
+	"os"
+)
+
+/*
+非unix平台不支持flock,多个进程或FileStore不能共用同一本地目录
+*/
+func tryLockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package rabbitmqpool
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+/*
+尝试获取文件的排他锁(flock),已被其他进程持有时返回errSpoolLockBusy
+进程退出时操作系统自动释放
+*/
+func tryLockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errSpoolLockBusy
+	}
+	return err
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
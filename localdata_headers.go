@@ -0,0 +1,240 @@
+package rabbitmqpool
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+/*
+本地文件中的消息头
+
+json无法区分amqp.Table中的整数/浮点数、[]byte、time.Time及嵌套的Table,
+消息头从message中取出,每个值按{"t":类型,"v":值}保存到记录的headers字段,重发时按类型还原
+*/
+type spoolValue struct {
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v,omitempty"`
+}
+
+type spoolRecordFields SpoolRecord
+
+func (rec *SpoolRecord) MarshalJSON() ([]byte, error) {
+	out := struct {
+		*spoolRecordFields
+		Headers map[string]spoolValue `json:"headers,omitempty"`
+	}{spoolRecordFields: (*spoolRecordFields)(rec)}
+	if rec.Message != nil && rec.Message.Headers != nil {
+		headers, err := encodeSpoolTable(rec.Message.Headers)
+		if err != nil {
+			return nil, err
+		}
+		msg := *rec.Message
+		msg.Headers = nil
+		fields := spoolRecordFields(*rec)
+		fields.Message = &msg
+		out.spoolRecordFields = &fields
+		out.Headers = headers
+	}
+	return json.Marshal(out)
+}
+
+func (rec *SpoolRecord) UnmarshalJSON(b []byte) error {
+	in := struct {
+		*spoolRecordFields
+		Headers map[string]spoolValue `json:"headers"`
+	}{spoolRecordFields: (*spoolRecordFields)(rec)}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	if rec.Message == nil {
+		return nil
+	}
+	if in.Headers != nil {
+		headers, err := decodeSpoolTable(in.Headers)
+		if err != nil {
+			return err
+		}
+		rec.Message.Headers = headers
+	} else if rec.Message.Headers != nil {
+		//旧版本记录的消息头按json类型保存,尽量还原为amqp支持的类型
+		rec.Message.Headers = restoreLegacyValue(rec.Message.Headers).(amqp.Table)
+	}
+	return nil
+}
+
+func encodeSpoolTable(table amqp.Table) (map[string]spoolValue, error) {
+	m := make(map[string]spoolValue, len(table))
+	for k, v := range table {
+		value, err := encodeSpoolValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("消息头%s: %w", k, err)
+		}
+		m[k] = value
+	}
+	return m, nil
+}
+
+/*
+按amqp.Table支持的类型编码,见amqp.Table.Validate
+*/
+func encodeSpoolValue(v interface{}) (spoolValue, error) {
+	var t string
+	switch fv := v.(type) {
+	case nil:
+		return spoolValue{Type: "nil"}, nil
+	case bool:
+		t = "bool"
+	case byte:
+		t = "uint8"
+	case int8:
+		t = "int8"
+	case int16:
+		t = "int16"
+	case int:
+		t = "int"
+	case int32:
+		t = "int32"
+	case int64:
+		t = "int64"
+	case float32:
+		t = "float32"
+	case float64:
+		t = "float64"
+	case string:
+		t = "string"
+	case []byte:
+		t = "bytes"
+	case amqp.Decimal:
+		t = "decimal"
+	case time.Time:
+		t = "time"
+	case []interface{}:
+		array := make([]spoolValue, len(fv))
+		for i, item := range fv {
+			value, err := encodeSpoolValue(item)
+			if err != nil {
+				return spoolValue{}, err
+			}
+			array[i] = value
+		}
+		t, v = "array", array
+	case amqp.Table:
+		table, err := encodeSpoolTable(fv)
+		if err != nil {
+			return spoolValue{}, err
+		}
+		t, v = "table", table
+	default:
+		return spoolValue{}, fmt.Errorf("不支持的类型%T", v)
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return spoolValue{}, err
+	}
+	return spoolValue{Type: t, Value: raw}, nil
+}
+
+func decodeSpoolTable(m map[string]spoolValue) (amqp.Table, error) {
+	table := make(amqp.Table, len(m))
+	for k, value := range m {
+		v, err := decodeSpoolValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("消息头%s: %w", k, err)
+		}
+		table[k] = v
+	}
+	return table, nil
+}
+
+func decodeSpoolValue(value spoolValue) (interface{}, error) {
+	switch value.Type {
+	case "nil":
+		return nil, nil
+	case "bool":
+		return decodeTyped[bool](value.Value)
+	case "uint8":
+		return decodeTyped[byte](value.Value)
+	case "int8":
+		return decodeTyped[int8](value.Value)
+	case "int16":
+		return decodeTyped[int16](value.Value)
+	case "int":
+		return decodeTyped[int](value.Value)
+	case "int32":
+		return decodeTyped[int32](value.Value)
+	case "int64":
+		return decodeTyped[int64](value.Value)
+	case "float32":
+		return decodeTyped[float32](value.Value)
+	case "float64":
+		return decodeTyped[float64](value.Value)
+	case "string":
+		return decodeTyped[string](value.Value)
+	case "bytes":
+		return decodeTyped[[]byte](value.Value)
+	case "decimal":
+		return decodeTyped[amqp.Decimal](value.Value)
+	case "time":
+		return decodeTyped[time.Time](value.Value)
+	case "array":
+		var items []spoolValue
+		if err := json.Unmarshal(value.Value, &items); err != nil {
+			return nil, err
+		}
+		array := make([]interface{}, len(items))
+		for i, item := range items {
+			v, err := decodeSpoolValue(item)
+			if err != nil {
+				return nil, err
+			}
+			array[i] = v
+		}
+		return array, nil
+	case "table":
+		var m map[string]spoolValue
+		if err := json.Unmarshal(value.Value, &m); err != nil {
+			return nil, err
+		}
+		return decodeSpoolTable(m)
+	}
+	return nil, fmt.Errorf("未知的类型%s", value.Type)
+}
+
+func decodeTyped[T any](raw json.RawMessage) (interface{}, error) {
+	var v T
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+/*
+旧版本记录: 对象还原为amqp.Table,整数还原为int64,[]byte及time.Time已无法区分,保留为字符串
+*/
+func restoreLegacyValue(v interface{}) interface{} {
+	switch fv := v.(type) {
+	case map[string]interface{}:
+		table := make(amqp.Table, len(fv))
+		for k, item := range fv {
+			table[k] = restoreLegacyValue(item)
+		}
+		return table
+	case amqp.Table:
+		return restoreLegacyValue(map[string]interface{}(fv))
+	case []interface{}:
+		array := make([]interface{}, len(fv))
+		for i, item := range fv {
+			array[i] = restoreLegacyValue(item)
+		}
+		return array
+	case float64:
+		if fv == math.Trunc(fv) && math.Abs(fv) < 1<<53 {
+			return int64(fv)
+		}
+	}
+	return v
+}
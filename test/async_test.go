@@ -0,0 +1,130 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+func TestPushAsyncClosed(t *testing.T) {
+	pool := rabbitmqpool.NewProductPool()
+	_ = pool.Close()
+	data := rabbitmqpool.GetRabbitMqDataFormat("testChange5", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "textQueue5", "textQueue5", "update", "")
+	future := pool.PushAsync(context.Background(), data)
+	select {
+	case <-future.Done():
+	case <-time.After(time.Second):
+		t.Fatal("future not completed after close")
+	}
+	if err := future.Wait(); err == nil || err.Code != rabbitmqpool.RCODE_ASYNC_QUEUE_ERROR {
+		t.Fatalf("push after close: %v", err)
+	}
+	done := make(chan *rabbitmqpool.RabbitMqError, 1)
+	pool.PushAsyncCallback(context.Background(), data, func(d *rabbitmqpool.RabbitMqData, err *rabbitmqpool.RabbitMqError) {
+		done <- err
+	})
+	if err := <-done; err == nil || err.Code != rabbitmqpool.RCODE_ASYNC_QUEUE_ERROR {
+		t.Fatalf("callback after close: %v", err)
+	}
+}
+
+func TestPushAsync(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.onRoute("nack", fakeNack)
+	store := rabbitmqpool.NewMemoryStore(0)
+	pool := rabbitmqpool.NewProductPool()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithPushMaxTime(2),
+		rabbitmqpool.WithPublisherConfirm(200*time.Millisecond),
+		rabbitmqpool.WithFailoverStore(store),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	ok := rabbitmqpool.GetRabbitMqDataFormat("async", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "async", "ok", "ok", "")
+	if err := pool.PushAsync(context.Background(), ok).Wait(); err != nil {
+		t.Fatalf("async push: %v", err)
+	}
+	if p := srv.waitPublished(1)[0]; p.Route != "ok" || string(p.Body) != "ok" {
+		t.Fatalf("unexpected publish: %+v", p)
+	}
+
+	//发送失败时回调得到最终结果,消息已写入存储
+	nack := rabbitmqpool.GetRabbitMqDataFormat("async", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "async", "nack", "nack", "")
+	type result struct {
+		data *rabbitmqpool.RabbitMqData
+		err  *rabbitmqpool.RabbitMqError
+	}
+	done := make(chan result, 1)
+	pool.PushAsyncCallback(context.Background(), nack, func(data *rabbitmqpool.RabbitMqData, err *rabbitmqpool.RabbitMqError) {
+		done <- result{data, err}
+	})
+	select {
+	case r := <-done:
+		if r.data != nack || r.err == nil || r.err.Code != rabbitmqpool.RCODE_PUSH_MAX_ERROR {
+			t.Fatalf("callback: %v %v", r.data, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not called")
+	}
+	if store.Len() != 1 {
+		t.Fatalf("store len = %d, want 1", store.Len())
+	}
+}
+
+func TestPushAsyncDrainOnClose(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.onRoute("slow", fakeNoConfirm)
+	store := rabbitmqpool.NewMemoryStore(0)
+	pool := rabbitmqpool.NewProductPool()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithPushMaxTime(2),
+		rabbitmqpool.WithPublisherConfirm(300*time.Millisecond),
+		rabbitmqpool.WithFailoverStore(store),
+		rabbitmqpool.WithAsyncWorkers(1),
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	//唯一的发送协程等待第一条消息的确认,其余消息留在队列中
+	slow := rabbitmqpool.GetRabbitMqDataFormat("async", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "async", "slow", "slow", "")
+	inflight := pool.PushAsync(context.Background(), slow)
+	srv.waitPublished(1)
+	var queued []*rabbitmqpool.PushFuture
+	for i := 0; i < 3; i++ {
+		data := rabbitmqpool.GetRabbitMqDataFormat("async", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "async", "queued", "queued", "")
+		queued = append(queued, pool.PushAsync(context.Background(), data))
+	}
+	_ = pool.Close()
+
+	//Close返回时所有消息都已完成: 发送中的消息超时后写入存储,队列中的消息直接写入存储
+	if err := inflight.Err(); err == nil || err.Code != rabbitmqpool.RCODE_PUSH_MAX_ERROR {
+		t.Fatalf("in-flight result: %v", err)
+	}
+	for i, f := range queued {
+		select {
+		case <-f.Done():
+		default:
+			t.Fatalf("queued %d not completed after Close", i)
+		}
+		if err := f.Err(); err != nil {
+			t.Fatalf("queued %d result: %v", i, err)
+		}
+	}
+	var routes []string
+	_ = store.Iterate(-1, func(rec *rabbitmqpool.SpoolRecord) bool {
+		routes = append(routes, rec.Message.Route)
+		return true
+	})
+	if len(routes) != 4 || routes[0] != "slow" {
+		t.Fatalf("spooled routes = %q", routes)
+	}
+	if published := srv.waitPublished(1); len(published) != 1 {
+		t.Fatalf("queued messages published after Close: %d", len(published))
+	}
+}
@@ -0,0 +1,151 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+func batchData(route string, exchangeType string) *rabbitmqpool.RabbitMqData {
+	return rabbitmqpool.GetRabbitMqDataFormat("batch", exchangeType, "batch", route, route, "")
+}
+
+func TestPushBatch(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.onRoute("nack", fakeNack)
+	srv.onRoute("timeout", fakeNoConfirm)
+	pool := rabbitmqpool.NewProductPool()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithPublisherConfirm(200*time.Millisecond),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	if results := pool.PushBatch(context.Background(), nil); len(results) != 0 {
+		t.Fatalf("empty batch results = %v", results)
+	}
+	batch := []*rabbitmqpool.RabbitMqData{
+		batchData("first", rabbitmqpool.EXCHANGE_TYPE_DIRECT),
+		batchData("invalid", "bogus"),
+		batchData("nack", rabbitmqpool.EXCHANGE_TYPE_DIRECT),
+		batchData("timeout", rabbitmqpool.EXCHANGE_TYPE_DIRECT),
+		batchData("last", rabbitmqpool.EXCHANGE_TYPE_DIRECT),
+	}
+	results := pool.PushBatch(context.Background(), batch)
+	if len(results) != len(batch) {
+		t.Fatalf("results = %d, want %d", len(results), len(batch))
+	}
+	//每条消息的结果对应各自的位置,失败的消息不影响其他消息
+	if results[0] != nil || results[4] != nil {
+		t.Fatalf("acked results = %v / %v", results[0], results[4])
+	}
+	if results[1] == nil || results[1].Code != rabbitmqpool.RCODE_CHANNEL_QUEUE_EXCHANGE_BIND_ERROR {
+		t.Fatalf("invalid exchange type result = %v", results[1])
+	}
+	if results[2] == nil || results[2].Code != rabbitmqpool.RCODE_PUSH_ERROR || !strings.Contains(results[2].Detail, rabbitmqpool.ErrPublishNack.Error()) {
+		t.Fatalf("nack result = %v", results[2])
+	}
+	if results[3] == nil || results[3].Code != rabbitmqpool.RCODE_PUSH_ERROR || !strings.Contains(results[3].Detail, rabbitmqpool.ErrConfirmTimeout.Error()) {
+		t.Fatalf("timeout result = %v", results[3])
+	}
+	var routes []string
+	for _, p := range srv.waitPublished(4) {
+		if !p.Confirm {
+			t.Fatalf("published without confirm: %+v", p)
+		}
+		routes = append(routes, p.Route)
+	}
+	if strings.Join(routes, ",") != "first,nack,timeout,last" {
+		t.Fatalf("published routes = %q", routes)
+	}
+}
+
+func TestPushBatchContext(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.onRoute("timeout", fakeNoConfirm)
+	pool := rabbitmqpool.NewProductPool()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithPublisherConfirm(5*time.Second),
+		rabbitmqpool.WithRateLimit(5, 1),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	//第一条消息使用桶中的令牌,之后的消息等待令牌时ctx超时
+	batch := []*rabbitmqpool.RabbitMqData{
+		batchData("first", rabbitmqpool.EXCHANGE_TYPE_DIRECT),
+		batchData("second", rabbitmqpool.EXCHANGE_TYPE_DIRECT),
+		batchData("third", rabbitmqpool.EXCHANGE_TYPE_DIRECT),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	results := pool.PushBatch(ctx, batch)
+	if results[0] != nil {
+		t.Fatalf("first result = %v", results[0])
+	}
+	for i, result := range results[1:] {
+		if result == nil || result.Code != rabbitmqpool.RCODE_RATE_LIMITED_ERROR {
+			t.Fatalf("result %d = %v, want rate limited", i+1, result)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if published := srv.waitPublished(1); len(published) != 1 || published[0].Route != "first" {
+		t.Fatalf("published = %+v", published)
+	}
+
+	//等待确认时取消,未确认的消息返回错误而不是等待超时
+	time.Sleep(200 * time.Millisecond)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	results = pool.PushBatch(ctx, []*rabbitmqpool.RabbitMqData{batchData("timeout", rabbitmqpool.EXCHANGE_TYPE_DIRECT)})
+	if results[0] == nil || results[0].Code != rabbitmqpool.RCODE_PUSH_ERROR {
+		t.Fatalf("cancelled result = %v", results[0])
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("cancelled batch took %s", elapsed)
+	}
+}
+
+func TestPushBatchRateLimit(t *testing.T) {
+	srv := newFakeServer(t)
+	pool := rabbitmqpool.NewProductPool()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithRateLimit(1, 2),
+		rabbitmqpool.WithRateLimitMode(rabbitmqpool.LIMIT_FAIL_FAST),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	batch := []*rabbitmqpool.RabbitMqData{
+		batchData("first", rabbitmqpool.EXCHANGE_TYPE_DIRECT),
+		batchData("second", rabbitmqpool.EXCHANGE_TYPE_DIRECT),
+		batchData("third", rabbitmqpool.EXCHANGE_TYPE_DIRECT),
+	}
+	results := pool.PushBatch(context.Background(), batch)
+	if results[0] != nil || results[1] != nil {
+		t.Fatalf("results = %v", results)
+	}
+	if results[2] == nil || results[2].Code != rabbitmqpool.RCODE_RATE_LIMITED_ERROR {
+		t.Fatalf("third result = %v, want rate limited", results[2])
+	}
+	if published := srv.waitPublished(2); len(published) != 2 {
+		t.Fatalf("published = %d, want 2", len(published))
+	}
+	stats := pool.RateLimitStats()
+	if len(stats) != 1 || stats[0].Allowed != 2 || stats[0].Rejected != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
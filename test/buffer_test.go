@@ -0,0 +1,85 @@
+package test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+func TestOutageBuffer(t *testing.T) {
+	data := rabbitmqpool.GetRabbitMqDataFormat("testChange5", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "textQueue5", "textQueue5", "update", "")
+
+	drop := rabbitmqpool.NewProductPool()
+	_ = drop.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", 1, "root", "root",
+		rabbitmqpool.WithOutageBuffer(1, rabbitmqpool.BUFFER_DROP), rabbitmqpool.WithFailoverStore(rabbitmqpool.NewNopStore())))
+	defer drop.Close()
+	if err := drop.Push(data); err != nil {
+		t.Fatalf("buffered push: %v", err)
+	}
+	if err := drop.Push(data); err == nil || err.Code != rabbitmqpool.RCODE_BUFFER_FULL_ERROR {
+		t.Fatalf("drop policy: %v", err)
+	}
+
+	block := rabbitmqpool.NewProductPool()
+	_ = block.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", 1, "root", "root",
+		rabbitmqpool.WithOutageBuffer(1, rabbitmqpool.BUFFER_BLOCK), rabbitmqpool.WithFailoverStore(rabbitmqpool.NewNopStore())))
+	defer block.Close()
+	_ = block.Push(data)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := block.PushWithContext(ctx, data); err == nil || err.Code != rabbitmqpool.RCODE_BUFFER_FULL_ERROR {
+		t.Fatalf("block policy: %v", err)
+	}
+
+	store := rabbitmqpool.NewMemoryStore(0)
+	spool := rabbitmqpool.NewProductPool()
+	_ = spool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", 1, "root", "root",
+		rabbitmqpool.WithOutageBuffer(1, rabbitmqpool.BUFFER_SPOOL), rabbitmqpool.WithFailoverStore(store)))
+	_ = spool.Push(data)
+	if err := spool.Push(data); err != nil || store.Len() != 1 {
+		t.Fatalf("spool policy: %v, store len %d", err, store.Len())
+	}
+	//关闭时缓冲区中的消息写入存储
+	_ = spool.Close()
+	if store.Len() != 2 {
+		t.Fatalf("store len after close = %d, want 2", store.Len())
+	}
+}
+
+func TestOutageBufferCloseBlockingStore(t *testing.T) {
+	store, err := rabbitmqpool.NewFileStore(filepath.Join(t.TempDir(), "block"),
+		rabbitmqpool.WithStoreMaxEntries(1),
+		rabbitmqpool.WithStoreOverflow(rabbitmqpool.OVERFLOW_BLOCK, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err = store.Append(newRecord(0)); err != nil {
+		t.Fatal(err)
+	}
+	pool := rabbitmqpool.NewProductPool()
+	_ = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", 1, "root", "root",
+		rabbitmqpool.WithOutageBuffer(10, rabbitmqpool.BUFFER_BLOCK), rabbitmqpool.WithFailoverStore(store)))
+	data := rabbitmqpool.GetRabbitMqDataFormat("testChange5", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "textQueue5", "textQueue5", "update", "")
+	if err := pool.Push(data); err != nil {
+		t.Fatalf("buffered push: %v", err)
+	}
+
+	//存储已满且不限等待时间,关闭时缓冲区写入存储不阻塞Close
+	done := make(chan struct{})
+	go func() {
+		_ = pool.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on a full store")
+	}
+	if store.Len() != 1 {
+		t.Fatalf("store len = %d, want 1", store.Len())
+	}
+}
@@ -0,0 +1,171 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sunerpy/rabbitmqpool"
+	"go.uber.org/zap"
+)
+
+/*
+编解码注册表是全局的,每次运行使用不同的content-type,-count>1时不受上次注册的影响
+*/
+type upperCodec struct {
+	contentType string
+}
+
+func (c upperCodec) ContentType() string { return c.contentType }
+
+func (upperCodec) Marshal(v interface{}) ([]byte, error) {
+	return []byte(strings.ToUpper(v.(string))), nil
+}
+
+func (upperCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = strings.ToLower(string(data))
+	return nil
+}
+
+type user struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func TestCodec(t *testing.T) {
+	data, err := rabbitmqpool.GetRabbitMqDataFormatValue("testChange5", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "textQueue5", "textQueue5", user{Name: "tom", Age: 3}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.ContentType != rabbitmqpool.CONTENT_TYPE_JSON || string(data.Body) != `{"name":"tom","age":3}` {
+		t.Fatalf("unexpected data: %s %s", data.ContentType, data.Body)
+	}
+	codec, err := rabbitmqpool.GetCodec("application/json; charset=utf-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u user
+	if err = codec.Unmarshal(data.Body, &u); err != nil || u.Name != "tom" {
+		t.Fatalf("decode: %+v %v", u, err)
+	}
+
+	//旧版本Push发送的text/plain及二进制数据按json解码
+	for _, contentType := range []string{"", "text/plain; charset=utf-8", "application/octet-stream"} {
+		if codec, err = rabbitmqpool.GetCodec(contentType); err != nil || codec.ContentType() != rabbitmqpool.CONTENT_TYPE_JSON {
+			t.Fatalf("fallback codec for %q: %v %v", contentType, codec, err)
+		}
+	}
+
+	contentType := fmt.Sprintf("text/x-upper-%d", time.Now().UnixNano())
+	if _, err = rabbitmqpool.GetCodec(contentType); !errors.Is(err, rabbitmqpool.ErrCodecNotFound) {
+		t.Fatalf("unregistered codec: %v", err)
+	}
+	rabbitmqpool.RegisterCodec(upperCodec{contentType: contentType})
+	data, err = rabbitmqpool.GetRabbitMqDataFormatValue("testChange5", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "textQueue5", "textQueue5", "hello", contentType, "")
+	if err != nil || string(data.Body) != "HELLO" || data.ContentType != contentType {
+		t.Fatalf("custom codec: %+v %v", data, err)
+	}
+}
+
+func TestConsumeDecode(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.enqueue("decode", fakeDelivery{ContentType: "text/plain", Body: []byte(`{"name":"tom","age":3}`)})
+	srv.enqueue("decode", fakeDelivery{ContentType: "application/x-unknown", Body: []byte("???")})
+	srv.enqueue("decode", fakeDelivery{ContentType: "application/x-unknown", Body: []byte("???"), Redelivered: true})
+	pool, err := rabbitmqpool.InitPool(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithRabbitType(rabbitmqpool.RABBITMQ_TYPE_CONSUME),
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithMaxConsumeChannel(1),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan user, 1)
+	fails := make(chan int, 3)
+	consumer := rabbitmqpool.NewConsumer[user]("decode", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "decode", "decode",
+		func(v user, delivery *amqp.Delivery, retryClient rabbitmqpool.RetryClientInterface, sLogger *zap.SugaredLogger) bool {
+			got <- v
+			_ = retryClient.Ack()
+			return true
+		})
+	consumer.EventFail = func(code int, e error, data []byte) {
+		fails <- code
+	}
+	consumer.Register(pool)
+	done := make(chan error, 1)
+	go func() {
+		done <- pool.RunConsume()
+	}()
+
+	//旧版本Push发送的text/plain按json解码
+	select {
+	case u := <-got:
+		if u.Name != "tom" || u.Age != 3 {
+			t.Fatalf("decoded %+v", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+	}
+	if settle := srv.waitSettle(); settle.Method != "ack" {
+		t.Fatalf("first settle = %+v, want ack", settle)
+	}
+	//无法解码的消息重新入队一次,不丢弃
+	if settle := srv.waitSettle(); settle.Method != "nack" || !settle.Requeue {
+		t.Fatalf("second settle = %+v, want nack requeue", settle)
+	}
+	//重新投递后仍无法解码时拒绝且不重新入队
+	if settle := srv.waitSettle(); settle.Method != "nack" || settle.Requeue {
+		t.Fatalf("redelivered settle = %+v, want nack without requeue", settle)
+	}
+	for i := 0; i < 2; i++ {
+		if code := <-fails; code != rabbitmqpool.RCODE_DECODE_ERROR {
+			t.Fatalf("fail code = %d", code)
+		}
+	}
+
+	_ = pool.Close()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunConsume did not return after Close")
+	}
+}
+
+func TestConsumeDecodeRetry(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.enqueue("decode", fakeDelivery{ContentType: "application/x-unknown", Body: []byte("???")})
+	pool, err := rabbitmqpool.InitPool(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithRabbitType(rabbitmqpool.RABBITMQ_TYPE_CONSUME),
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithMaxConsumeChannel(1),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer := rabbitmqpool.NewConsumer[user]("decode", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "decode", "decode",
+		func(v user, delivery *amqp.Delivery, retryClient rabbitmqpool.RetryClientInterface, sLogger *zap.SugaredLogger) bool {
+			return true
+		})
+	consumer.IsTry = true
+	consumer.MaxReTry = 3
+	consumer.Register(pool)
+	go func() {
+		_ = pool.RunConsume()
+	}()
+	defer pool.Close()
+
+	//设置了重试时进入重试队列,原消息确认
+	if settle := srv.waitSettle(); settle.Method != "ack" {
+		t.Fatalf("settle = %+v, want ack", settle)
+	}
+	published := srv.waitPublished(1)
+	if published[0].Exchange != "decode-dead" || string(published[0].Body) != "???" || published[0].ContentType != "application/x-unknown" {
+		t.Fatalf("retry publish: %+v", published[0])
+	}
+}
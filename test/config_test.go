@@ -0,0 +1,111 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "rabbitmq.yaml")
+	if err := os.WriteFile(yamlFile, []byte(`
+host: 10.0.0.1
+port: 5672
+hosts: [10.0.0.2, "10.0.0.3:5673"]
+endpoint_strategy: round_robin
+user: root
+password: root
+vhost: orders
+max_connection: 3
+retry:
+  push_max_time: 2
+  min_random_time: 100
+  max_random_time: 200
+spool:
+  dir: `+filepath.Join(dir, "spool")+`
+  replay_interval: 10s
+  sync: always
+  overflow: block
+  block_timeout: 1s
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := rabbitmqpool.LoadConfigFile(yamlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Host != "10.0.0.1" || len(c.Hosts) != 2 || c.Retry.PushMaxTime != 2 || c.Spool.Sync != "always" {
+		t.Fatalf("unexpected config: %+v", c)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TESTMQ_HOST", "127.0.0.1")
+	t.Setenv("TESTMQ_PORT", "1")
+	t.Setenv("TESTMQ_HOSTS", "")
+	t.Setenv("TESTMQ_SPOOL_SYNC", "never")
+	conf, err := rabbitmqpool.LoadAmqpConf(yamlFile, "TESTMQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := rabbitmqpool.NewProductPool()
+	defer pool.Close()
+	_ = pool.Connect(conf)
+	if pool.GetHost() != "127.0.0.1" || pool.GetPort() != 1 {
+		t.Fatalf("env not applied: %s:%d", pool.GetHost(), pool.GetPort())
+	}
+
+	jsonFile := filepath.Join(dir, "rabbitmq.json")
+	if err := os.WriteFile(jsonFile, []byte(`{"host":"h","user":"u","tls":{"ca_file":"ca.pem"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = rabbitmqpool.LoadConfigFile(jsonFile); err != nil || c.TLS.CAFile != "ca.pem" {
+		t.Fatalf("json: %+v %v", c, err)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.yaml")
+	if err := os.WriteFile(unknown, []byte("host: h\nhostname: h\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rabbitmqpool.LoadConfigFile(unknown); !errors.Is(err, rabbitmqpool.ErrInvalidConfig) {
+		t.Fatalf("unknown field: %v", err)
+	}
+	if _, err := rabbitmqpool.LoadConfigFile(filepath.Join(dir, "conf.toml")); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+
+	t.Setenv("BADMQ_PORT", "abc")
+	if err := (&rabbitmqpool.RabbitConfig{}).LoadEnv("BADMQ"); !errors.Is(err, rabbitmqpool.ErrInvalidConfig) || !strings.Contains(err.Error(), "BADMQ_PORT") {
+		t.Fatalf("env: %v", err)
+	}
+
+	c := &rabbitmqpool.RabbitConfig{
+		Port:  70000,
+		Hosts: []string{"a:b"},
+		Type:  "worker",
+		Retry: rabbitmqpool.RabbitRetryConfig{MinRandomTime: 10, MaxRandomTime: 5},
+		TLS:   rabbitmqpool.RabbitTLSConfig{CertFile: "client.pem", MinVersion: "1.4"},
+		Spool: rabbitmqpool.RabbitSpoolConfig{ReplayInterval: "soon", Sync: "sometimes", EncryptionKey: "c2hvcnQ="},
+	}
+	err := c.Validate()
+	if !errors.Is(err, rabbitmqpool.ErrInvalidConfig) {
+		t.Fatalf("expected ErrInvalidConfig, got %v", err)
+	}
+	for _, field := range []string{"host", "user", "port", "hosts", "type", "retry.min_random_time", "tls", "tls.min_version", "spool.replay_interval", "spool.sync", "spool.encryption_key"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("missing error for %s in %v", field, err)
+		}
+	}
+	if _, err := c.AmqpConf(); err == nil {
+		t.Fatal("AmqpConf should reject invalid config")
+	}
+}
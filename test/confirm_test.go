@@ -0,0 +1,108 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+func TestPublisherConfirm(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.onRoute("nack", fakeNack)
+	srv.onRoute("timeout", fakeNoConfirm)
+	store := rabbitmqpool.NewMemoryStore(0)
+	pool := rabbitmqpool.NewProductPool()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithPushMaxTime(2),
+		rabbitmqpool.WithPublisherConfirm(200*time.Millisecond),
+		rabbitmqpool.WithFailoverStore(store),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	ack := rabbitmqpool.GetRabbitMqDataFormat("confirm", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "confirm", "ack", "ack", "")
+	if err := pool.Push(ack); err != nil {
+		t.Fatalf("acked push: %v", err)
+	}
+	if p := srv.waitPublished(1)[0]; !p.Confirm || string(p.Body) != "ack" {
+		t.Fatalf("unexpected publish: %+v", p)
+	}
+	if store.Len() != 0 {
+		t.Fatalf("acked message spooled")
+	}
+
+	for _, route := range []string{"nack", "timeout"} {
+		data := rabbitmqpool.GetRabbitMqDataFormat("confirm", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "confirm", route, route, "")
+		err := pool.Push(data)
+		if err == nil || err.Code != rabbitmqpool.RCODE_PUSH_MAX_ERROR {
+			t.Fatalf("%s push: %v", route, err)
+		}
+		want := rabbitmqpool.ErrPublishNack
+		if route == "timeout" {
+			want = rabbitmqpool.ErrConfirmTimeout
+		}
+		if !strings.Contains(err.Detail, want.Error()) {
+			t.Fatalf("%s detail = %q, want %q", route, err.Detail, want)
+		}
+	}
+	var reasons []string
+	_ = store.Iterate(-1, func(rec *rabbitmqpool.SpoolRecord) bool {
+		reasons = append(reasons, rec.Reason)
+		return true
+	})
+	if len(reasons) != 2 || reasons[0] != rabbitmqpool.ErrPublishNack.Error() || reasons[1] != rabbitmqpool.ErrConfirmTimeout.Error() {
+		t.Fatalf("spooled reasons = %q", reasons)
+	}
+
+	//等待确认时ctx取消,不重试也不写入存储
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	data := rabbitmqpool.GetRabbitMqDataFormat("confirm", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "confirm", "timeout", "cancel", "")
+	if err := pool.PushWithContext(ctx, data); err == nil || err.Code != rabbitmqpool.RCODE_CONNECTION_ERROR {
+		t.Fatalf("cancelled push: %v", err)
+	}
+	if store.Len() != 2 {
+		t.Fatalf("cancelled message spooled")
+	}
+}
+
+/*
+等待确认时不持有信道池锁,多个生产者并发等待
+*/
+func TestPublisherConfirmConcurrent(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.onRoute("timeout", fakeNoConfirm)
+	pool := rabbitmqpool.NewProductPool()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithPushMaxTime(2),
+		rabbitmqpool.WithPublisherConfirm(300*time.Millisecond),
+		rabbitmqpool.WithFailoverStore(rabbitmqpool.NewNopStore()),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := rabbitmqpool.GetRabbitMqDataFormat("confirm", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "confirm", "timeout", "slow", "")
+			if err := pool.Push(data); err == nil {
+				t.Error("unconfirmed push succeeded")
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Fatalf("confirm waits serialized: %s", elapsed)
+	}
+}
@@ -0,0 +1,184 @@
+package test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+func receiveStartOk(t *testing.T, startOk <-chan []byte) []byte {
+	select {
+	case payload := <-startOk:
+		return payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection.start-ok received")
+	}
+	return nil
+}
+
+func TestConnectionName(t *testing.T) {
+	port, startOk := fakeBroker(t, "PLAIN AMQPLAIN")
+
+	pool := rabbitmqpool.NewProductPool()
+	defer pool.Close()
+	_ = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", port, "guest", "guest",
+		rabbitmqpool.WithConnectionName("orders"),
+		rabbitmqpool.WithClientProperties(amqp.Table{"team": "payments"}),
+		rabbitmqpool.WithLocale("zh_CN"),
+		rabbitmqpool.WithHeartbeat(5*time.Second),
+		rabbitmqpool.WithDialTimeout(time.Second),
+	))
+	payload := receiveStartOk(t, startOk)
+	for _, want := range []string{"orders-producer-0", "payments", "zh_CN", "AMQP 0.9.1 Client"} {
+		if !bytes.Contains(payload, []byte(want)) {
+			t.Errorf("start-ok missing %q", want)
+		}
+	}
+
+	consumer := rabbitmqpool.NewConsumePool()
+	defer consumer.Close()
+	_ = consumer.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", port, "guest", "guest",
+		rabbitmqpool.WithClientProperties(amqp.Table{"connection_name": "custom-name"}),
+	))
+	payload = receiveStartOk(t, startOk)
+	if !bytes.Contains(payload, []byte("custom-name")) || bytes.Contains(payload, []byte("-consumer-0")) {
+		t.Errorf("connection_name property not respected")
+	}
+}
+
+func TestDeadConnection(t *testing.T) {
+	srv := newFakeServer(t)
+	pool := rabbitmqpool.NewProductPool()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithMaxRetry(1, 1),
+		rabbitmqpool.WithFailoverStore(rabbitmqpool.NewNopStore()),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if err := pool.Push(rabbitmqpool.GetRabbitMqDataFormat("dead", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "dead", "first", "first", "")); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	//连接断开且无法重连,未创建过信道的消息返回错误
+	_ = srv.listener.Close()
+	srv.dropConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.IsHealthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("pool still healthy after connections dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := pool.Push(rabbitmqpool.GetRabbitMqDataFormat("dead", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "dead", "second", "second", "")); err == nil {
+		t.Fatal("push on dead connection succeeded")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	srv := newFakeServer(t)
+	for i, heartbeat := range []time.Duration{500 * time.Millisecond, 0, 3 * time.Second} {
+		pool := rabbitmqpool.NewProductPool()
+		if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+			rabbitmqpool.WithMaxConnection(1),
+			rabbitmqpool.WithHeartbeat(heartbeat),
+		)); err != nil {
+			t.Fatal(err)
+		}
+		_ = pool.Close()
+		if got := srv.heartbeats(); len(got) != i+1 {
+			t.Fatalf("heartbeats = %v", got)
+		}
+	}
+	//不足1秒的心跳按1秒,0关闭心跳
+	if got := srv.heartbeats(); got[0] != 1 || got[1] != 0 || got[2] != 3 {
+		t.Fatalf("heartbeats = %v, want [1 0 3]", got)
+	}
+}
+
+func TestHealthDuringReconnect(t *testing.T) {
+	srv := newFakeServer(t)
+	conf := rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(2),
+		rabbitmqpool.WithFailoverStore(rabbitmqpool.NewNopStore()),
+	)
+	pool := rabbitmqpool.NewProductPool()
+	if err := pool.Connect(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	//健康检查与断线、重建连接池(同monitorPool)同时进行,-race下不应有数据竞争
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				pool.IsHealthy()
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		srv.dropConnections()
+		time.Sleep(50 * time.Millisecond)
+		if err := pool.Connect(conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func TestPushAfterClose(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	pool := rabbitmqpool.NewProductPool()
+	_ = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", 1, "root", "root",
+		rabbitmqpool.WithMaxRetry(1, 1),
+		rabbitmqpool.WithSpoolDir(dir),
+	))
+	_ = pool.Close()
+
+	//关闭后不再打开本地文件存储
+	if err := pool.Push(rabbitmqpool.GetRabbitMqDataFormat("closed", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "closed", "closed", "closed", "")); err == nil {
+		t.Fatal("push after close succeeded")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("spool dir opened after close: %v", err)
+	}
+}
+
+func TestReconnectAfterClose(t *testing.T) {
+	srv := newFakeServer(t)
+	conf := rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest", rabbitmqpool.WithMaxConnection(2))
+	pool := rabbitmqpool.NewProductPool()
+	if err := pool.Connect(conf); err != nil {
+		t.Fatal(err)
+	}
+	_ = pool.Close()
+
+	//关闭后重建连接池(同monitorPool)不保留新建立的连接
+	if err := pool.Connect(conf); err == nil {
+		t.Fatal("connect after close succeeded")
+	}
+	if pool.IsHealthy() {
+		t.Fatal("closed pool is healthy")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.connections() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections left open after close", srv.connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
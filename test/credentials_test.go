@@ -0,0 +1,85 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+func TestFileCredentials(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	writeSecret := func(value string, modTime time.Time) {
+		if err := os.WriteFile(passwordFile, []byte(value+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(passwordFile, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	writeSecret("secret-1", now)
+
+	provider := rabbitmqpool.NewFileCredentials("", passwordFile)
+	if user, password, err := provider.Credentials(); err != nil || user != "" || password != "secret-1" {
+		t.Fatalf("got %q %q %v", user, password, err)
+	}
+
+	srv := newFakeServer(t)
+	pool := rabbitmqpool.NewProductPool()
+	defer pool.Close()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "root", "",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithCredentialsProvider(provider),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if payloads := srv.startOkPayloads(); len(payloads) != 1 || !bytes.Contains(payloads[0], []byte("\x00root\x00secret-1")) {
+		t.Fatal("first connection did not use secret-1")
+	}
+
+	//轮换后连接断开,发送时自动重连使用新密码
+	writeSecret("secret-2", now.Add(time.Minute))
+	srv.dropConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.IsHealthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("pool still healthy after connections dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := pool.Push(rabbitmqpool.GetRabbitMqDataFormat("rotate", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "rotate", "rotate", "rotate", "")); err != nil {
+		t.Fatalf("push after reconnect: %v", err)
+	}
+	if payloads := srv.startOkPayloads(); len(payloads) != 2 || !bytes.Contains(payloads[1], []byte("\x00root\x00secret-2")) {
+		t.Fatal("reconnect did not pick up rotated secret")
+	}
+
+	//文件暂时不可读时使用上次的值
+	if err := os.Remove(passwordFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, password, err := provider.Credentials(); err != nil || password != "secret-2" {
+		t.Fatalf("got %q %v", password, err)
+	}
+	if _, _, err := rabbitmqpool.NewFileCredentials("", passwordFile).Credentials(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+}
+
+func TestStaticCredentials(t *testing.T) {
+	port, startOk := fakeBroker(t, "PLAIN")
+	pool := rabbitmqpool.NewProductPool()
+	defer pool.Close()
+	_ = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", port, "root", "old",
+		rabbitmqpool.WithCredentialsProvider(rabbitmqpool.NewStaticCredentials("app", "p@ss/w%rd")),
+	))
+	if payload := receiveStartOk(t, startOk); !bytes.Contains(payload, []byte("\x00app\x00p@ss/w%rd")) {
+		t.Fatal("static credentials not used")
+	}
+}
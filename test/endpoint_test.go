@@ -0,0 +1,135 @@
+package test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+/*
+第一个节点不可用时切换到下一个节点
+本地监听代替broker,只记录是否收到连接
+*/
+func TestEndpointFailover(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := dead.Addr().(*net.TCPAddr).Port
+	dead.Close()
+
+	alive, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		conn, err := alive.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- struct{}{}
+		conn.Close()
+	}()
+
+	pool := rabbitmqpool.NewProductPool()
+	defer pool.Close()
+	_ = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", deadPort, "root", "root",
+		rabbitmqpool.WithEndpoint("127.0.0.1", alive.Addr().(*net.TCPAddr).Port),
+		rabbitmqpool.WithEndpointStrategy(rabbitmqpool.ENDPOINT_ORDERED)))
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second endpoint not tried")
+	}
+}
+
+/*
+ENDPOINT_ROUND_ROBIN时连接池的各连接依次分散到各节点
+*/
+func TestEndpointRoundRobin(t *testing.T) {
+	servers := []*fakeServer{newFakeServer(t), newFakeServer(t), newFakeServer(t)}
+	pool := rabbitmqpool.NewProductPool()
+	defer pool.Close()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", servers[0].port, "guest", "guest",
+		rabbitmqpool.WithEndpoint("127.0.0.1", servers[1].port),
+		rabbitmqpool.WithEndpoint("127.0.0.1", servers[2].port),
+		rabbitmqpool.WithEndpointStrategy(rabbitmqpool.ENDPOINT_ROUND_ROBIN),
+		rabbitmqpool.WithMaxConnection(6))); err != nil {
+		t.Fatal(err)
+	}
+	for i, srv := range servers {
+		if n := len(srv.startOkPayloads()); n != 2 {
+			t.Errorf("endpoint %d: %d connections, want 2", i, n)
+		}
+	}
+}
+
+/*
+ENDPOINT_SHUFFLE时连接随机分布到各节点,ENDPOINT_ORDERED时全部连接第一个节点
+*/
+func TestEndpointShuffle(t *testing.T) {
+	for _, strategy := range []int{rabbitmqpool.ENDPOINT_ORDERED, rabbitmqpool.ENDPOINT_SHUFFLE} {
+		first, second := newFakeServer(t), newFakeServer(t)
+		pool := rabbitmqpool.NewProductPool()
+		if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", first.port, "guest", "guest",
+			rabbitmqpool.WithEndpoint("127.0.0.1", second.port),
+			rabbitmqpool.WithEndpointStrategy(strategy),
+			rabbitmqpool.WithMaxConnection(20))); err != nil {
+			t.Fatal(err)
+		}
+		_ = pool.Close()
+		n1, n2 := len(first.startOkPayloads()), len(second.startOkPayloads())
+		if n1+n2 != 20 {
+			t.Fatalf("strategy %d: %d+%d connections, want 20", strategy, n1, n2)
+		}
+		if strategy == rabbitmqpool.ENDPOINT_ORDERED && n2 != 0 {
+			t.Fatalf("ordered: %d connections to the second endpoint", n2)
+		}
+		//20个连接全部落在同一节点的概率为2^-19
+		if strategy == rabbitmqpool.ENDPOINT_SHUFFLE && (n1 == 0 || n2 == 0) {
+			t.Fatalf("shuffle: %d/%d connections", n1, n2)
+		}
+	}
+}
+
+/*
+连接断开后发送时重连,当前节点不可用时切换到下一个节点
+*/
+func TestEndpointReconnectFailover(t *testing.T) {
+	first, second := newFakeServer(t), newFakeServer(t)
+	pool := rabbitmqpool.NewProductPool()
+	defer pool.Close()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", first.port, "guest", "guest",
+		rabbitmqpool.WithEndpoint("127.0.0.1", second.port),
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithFailoverStore(rabbitmqpool.NewNopStore()))); err != nil {
+		t.Fatal(err)
+	}
+	if len(first.startOkPayloads()) != 1 || len(second.startOkPayloads()) != 0 {
+		t.Fatal("first connection not on the first endpoint")
+	}
+
+	//第一个节点停止
+	_ = first.listener.Close()
+	first.dropConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.IsHealthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("pool still healthy after the endpoint stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := pool.Push(rabbitmqpool.GetRabbitMqDataFormat("failover", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "failover", "ok", "ok", "")); err != nil {
+		t.Fatalf("push after failover: %v", err)
+	}
+	if p := second.waitPublished(1)[0]; p.Route != "ok" {
+		t.Fatalf("unexpected publish: %+v", p)
+	}
+	if len(first.startOkPayloads()) != 1 {
+		t.Fatal("reconnected to the stopped endpoint")
+	}
+}
@@ -0,0 +1,610 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+func newRecord(i int) *rabbitmqpool.SpoolRecord {
+	data := rabbitmqpool.GetRabbitMqDataFormat("testChange5", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "textQueue5", "textQueue5", fmt.Sprintf("update num is %d", i), "")
+	return &rabbitmqpool.SpoolRecord{Message: data, Reason: "test", Attempts: 1}
+}
+
+func iterateAll(t *testing.T, store rabbitmqpool.FailoverStore, max int) []*rabbitmqpool.SpoolRecord {
+	var records []*rabbitmqpool.SpoolRecord
+	err := store.Iterate(max, func(rec *rabbitmqpool.SpoolRecord) bool {
+		records = append(records, rec)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+	return records
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := rabbitmqpool.NewMemoryStore(3)
+	for i := 0; i < 3; i++ {
+		if err := store.Append(newRecord(i)); err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+	}
+	if err := store.Append(newRecord(3)); !errors.Is(err, rabbitmqpool.ErrFailoverStoreFull) {
+		t.Fatalf("append over capacity: %v", err)
+	}
+	records := iterateAll(t, store, 2)
+	if len(records) != 2 || records[0].Message.Data != "update num is 0" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if err := store.Ack(2); err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 1 {
+		t.Fatalf("len = %d, want 1", store.Len())
+	}
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	store, err := rabbitmqpool.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiLine := newRecord(0)
+	multiLine.Message.Data = jsonData
+	if err = store.Append(multiLine); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 5; i++ {
+		if err = store.Append(newRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records := iterateAll(t, store, 2)
+	if len(records) != 2 || records[0].Message.Data != jsonData || records[0].Message.ExchangeName != "testChange5" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if err = store.Ack(2); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	store, err = rabbitmqpool.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Len() != 3 {
+		t.Fatalf("len after reopen = %d, want 3", store.Len())
+	}
+	records = iterateAll(t, store, -1)
+	if len(records) != 3 || records[0].Message.Data != "update num is 2" {
+		t.Fatalf("unexpected records after reopen: %+v", records)
+	}
+}
+
+func TestFileStoreLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "localdata.txt")
+	if err := os.WriteFile(path, []byte("update num is 1\nupdate num is 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := rabbitmqpool.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	records := iterateAll(t, store, -1)
+	if len(records) != 2 || !records[0].Legacy || records[1].Message.Data != "update num is 2" {
+		t.Fatalf("unexpected legacy records: %+v", records)
+	}
+	//.txt路径使用去掉扩展名的目录
+	if info, err := os.Stat(strings.TrimSuffix(path, ".txt")); err != nil || !info.IsDir() {
+		t.Fatalf("spool dir not created: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("legacy file not imported: %v", err)
+	}
+}
+
+func TestSpoolFileAlias(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, "localdata.txt")
+	writeLegacy := func(line string) {
+		if err := os.WriteFile(legacy, []byte(line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeLegacy("old 1")
+	pool := rabbitmqpool.NewProductPool()
+	_ = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", 1, "root", "root", rabbitmqpool.WithSpoolFile(legacy)))
+	data := rabbitmqpool.GetRabbitMqDataFormat("testChange5", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "textQueue5", "textQueue5", "new 1", "")
+	if err := pool.Push(data); err == nil || err.Code != rabbitmqpool.RCODE_PUSH_MAX_ERROR {
+		t.Fatalf("push without connection: %v", err)
+	}
+	//目录已打开后,Localfile指向的旧版本文件也会被导入
+	writeLegacy("old 2")
+	data = rabbitmqpool.GetRabbitMqDataFormat("testChange5", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "textQueue5", "textQueue5", "new 2", legacy)
+	if err := pool.Push(data); err == nil || err.Code != rabbitmqpool.RCODE_PUSH_MAX_ERROR {
+		t.Fatalf("push without connection: %v", err)
+	}
+	_ = pool.Close()
+
+	store, err := rabbitmqpool.NewFileStore(filepath.Join(dir, "localdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	var got []string
+	for _, rec := range iterateAll(t, store, -1) {
+		got = append(got, rec.Message.Data)
+	}
+	if strings.Join(got, ",") != "old 1,new 1,old 2,new 2" {
+		t.Fatalf("records = %q", got)
+	}
+}
+
+func TestFileStoreOverflow(t *testing.T) {
+	reject, err := rabbitmqpool.NewFileStore(filepath.Join(t.TempDir(), "reject"), rabbitmqpool.WithStoreMaxEntries(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reject.Close()
+	_ = reject.Append(newRecord(0))
+	_ = reject.Append(newRecord(1))
+	if err = reject.Append(newRecord(2)); !errors.Is(err, rabbitmqpool.ErrFailoverStoreFull) {
+		t.Fatalf("reject policy: %v", err)
+	}
+
+	drop, err := rabbitmqpool.NewFileStore(filepath.Join(t.TempDir(), "drop"),
+		rabbitmqpool.WithStoreMaxEntries(3),
+		rabbitmqpool.WithStoreSegmentBytes(256),
+		rabbitmqpool.WithStoreOverflow(rabbitmqpool.OVERFLOW_DROP_OLDEST, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer drop.Close()
+	for i := 0; i < 10; i++ {
+		err = drop.Append(newRecord(i))
+		if i < 3 && err != nil || i >= 3 && !errors.Is(err, rabbitmqpool.ErrFailoverStoreDropped) {
+			t.Fatalf("drop policy append %d: %v", i, err)
+		}
+	}
+	records := iterateAll(t, drop, -1)
+	if drop.Len() != 3 || len(records) != 3 || records[0].Message.Data != "update num is 7" {
+		t.Fatalf("drop policy kept %d records: %+v", drop.Len(), records)
+	}
+
+	block, err := rabbitmqpool.NewFileStore(filepath.Join(t.TempDir(), "block"),
+		rabbitmqpool.WithStoreMaxEntries(1),
+		rabbitmqpool.WithStoreOverflow(rabbitmqpool.OVERFLOW_BLOCK, 200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer block.Close()
+	_ = block.Append(newRecord(0))
+	if err = block.Append(newRecord(1)); !errors.Is(err, rabbitmqpool.ErrFailoverStoreFull) {
+		t.Fatalf("block policy timeout: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- block.Append(newRecord(2))
+	}()
+	iterateAll(t, block, 1)
+	if err = block.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("block policy after ack: %v", err)
+	}
+}
+
+func TestFileStoreCorruptRecords(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	store, err := rabbitmqpool.NewFileStore(dir, rabbitmqpool.WithStoreSync(rabbitmqpool.FSYNC_ALWAYS, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = store.Append(newRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = store.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(segments) != 1 {
+		t.Fatalf("segments = %v", segments)
+	}
+	content, err := os.ReadFile(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	//篡改第二条记录并追加一条写了一半的记录
+	second := strings.Index(string(content), "update num is 1")
+	content[second] = 'U'
+	content = append(content, []byte("0000abcd {\"message\":{\"Data\":\"torn")...)
+	if err = os.WriteFile(segments[0], content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = rabbitmqpool.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err = store.Append(newRecord(3)); err != nil {
+		t.Fatal(err)
+	}
+	records := iterateAll(t, store, -1)
+	if len(records) != 3 || records[1].Message.Data != "update num is 2" || records[2].Message.Data != "update num is 3" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if err = store.Ack(3); err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 0 {
+		t.Fatalf("len = %d, want 0", store.Len())
+	}
+	quarantine, err := os.ReadFile(filepath.Join(dir, rabbitmqpool.SPOOL_QUARANTINE_FILE))
+	if err != nil || strings.Count(string(quarantine), "\n") != 2 {
+		t.Fatalf("quarantine: %q %v", quarantine, err)
+	}
+}
+
+func TestFileStoreLock(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	first, err := rabbitmqpool.NewFileStore(dir, rabbitmqpool.WithStoreSegmentBytes(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := rabbitmqpool.NewFileStore(dir, rabbitmqpool.WithStoreSegmentBytes(1024))
+	if err != nil {
+		t.Fatalf("second open: %v", err)
+	}
+	defer second.Close()
+
+	// 两个FileStore同时写入同一目录,分段切换由任意一方完成
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for _, store := range []*rabbitmqpool.FileStore{first, second} {
+		wg.Add(1)
+		go func(store *rabbitmqpool.FileStore) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				errs <- store.Append(newRecord(i))
+			}
+		}(store)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	if first.Len() != 40 || second.Len() != 40 {
+		t.Fatalf("len = %d/%d, want 40", first.Len(), second.Len())
+	}
+
+	// 先遍历的一方获得重发权,另一方不返回记录
+	if records := iterateAll(t, first, -1); len(records) != 40 {
+		t.Fatalf("owner records = %d, want 40", len(records))
+	}
+	if records := iterateAll(t, second, -1); len(records) != 0 {
+		t.Fatalf("non-owner records = %d, want 0", len(records))
+	}
+	if err = first.Ack(40); err != nil {
+		t.Fatal(err)
+	}
+	if second.Len() != 0 {
+		t.Fatalf("len after ack = %d, want 0", second.Len())
+	}
+
+	// 持有方关闭后由另一方接管
+	if err = second.Append(newRecord(40)); err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	records := iterateAll(t, second, -1)
+	if len(records) != 1 || records[0].Message.Data != "update num is 40" {
+		t.Fatalf("records after takeover: %+v", records)
+	}
+	if err = second.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if second.Len() != 0 {
+		t.Fatalf("len = %d, want 0", second.Len())
+	}
+}
+
+func TestFileStoreEncryption(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	store, err := rabbitmqpool.NewFileStore(dir, rabbitmqpool.WithStoreEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := newRecord(0)
+	secret.Message.Data = jsonData
+	if err = store.Append(secret); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(segments) != 1 {
+		t.Fatalf("segments = %v", segments)
+	}
+	info, err := os.Stat(segments[0])
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("segment mode: %v %v", info.Mode(), err)
+	}
+	content, _ := os.ReadFile(segments[0])
+	if strings.Contains(string(content), "new_pass") || strings.Contains(string(content), "testChange5") {
+		t.Fatalf("spool not encrypted: %s", content)
+	}
+
+	store, err = rabbitmqpool.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Iterate(-1, func(rec *rabbitmqpool.SpoolRecord) bool { return true }); !errors.Is(err, rabbitmqpool.ErrSpoolDecrypt) {
+		t.Fatalf("iterate without key: %v", err)
+	}
+	if store.Len() != 1 {
+		t.Fatalf("len without key = %d, want 1", store.Len())
+	}
+	_ = store.Close()
+
+	store, err = rabbitmqpool.NewFileStore(dir, rabbitmqpool.WithStoreEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	records := iterateAll(t, store, -1)
+	if len(records) != 1 || records[0].Message.Data != jsonData {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if _, err = rabbitmqpool.NewFileStore(filepath.Join(t.TempDir(), "bad"), rabbitmqpool.WithStoreEncryptionKey([]byte("short"))); err == nil {
+		t.Fatal("invalid key accepted")
+	}
+}
+
+func TestFileStoreMessageProperties(t *testing.T) {
+	store, err := rabbitmqpool.NewFileStore(filepath.Join(t.TempDir(), "spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	rec := newRecord(0)
+	rec.Message.Headers = map[string]interface{}{"tenant": "a"}
+	rec.Message.ContentType = "application/json"
+	rec.Message.MessageId = "id-1"
+	rec.Message.Priority = 5
+	rec.Message.Expiration = "60000"
+	rec.Message.DeliveryMode = 1
+	if err = store.Append(rec); err != nil {
+		t.Fatal(err)
+	}
+	records := iterateAll(t, store, -1)
+	msg := records[0].Message
+	if msg.Headers["tenant"] != "a" || msg.ContentType != "application/json" || msg.MessageId != "id-1" ||
+		msg.Priority != 5 || msg.Expiration != "60000" || msg.DeliveryMode != 1 {
+		t.Fatalf("properties lost: %+v", msg)
+	}
+}
+
+func TestFileStoreBinaryBody(t *testing.T) {
+	store, err := rabbitmqpool.NewFileStore(filepath.Join(t.TempDir(), "spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	body := []byte{0x00, 0x0a, 0xff, '\r', '\n', 0x7b}
+	data := rabbitmqpool.GetRabbitMqDataFormatBytes("testChange5", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "textQueue5", "textQueue5", body, "")
+	if err = store.Append(&rabbitmqpool.SpoolRecord{Message: data}); err != nil {
+		t.Fatal(err)
+	}
+	records := iterateAll(t, store, -1)
+	if len(records) != 1 || !bytes.Equal(records[0].Message.Body, body) || records[0].Legacy {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+}
+
+func TestReplayPoisonRecord(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.onRoute("unroutable", fakeReturn)
+	dir := filepath.Join(t.TempDir(), "spool")
+	store, err := rabbitmqpool.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poison := rabbitmqpool.GetRabbitMqDataFormat("replay", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "replay", "unroutable", "poison", "")
+	poison.Mandatory = true
+	good := rabbitmqpool.GetRabbitMqDataFormat("replay", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "replay", "ok", "good", "")
+	for _, data := range []*rabbitmqpool.RabbitMqData{poison, good} {
+		if err = store.Append(&rabbitmqpool.SpoolRecord{Message: data, Reason: "test", Attempts: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = store.Close()
+
+	pool, err := rabbitmqpool.InitPool(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithSpoolDir(dir),
+		rabbitmqpool.WithReplayInterval(50*time.Millisecond),
+		rabbitmqpool.WithReplayMaxAttempts(2),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//第一条记录失败2次后被隔离,之后的记录继续重发
+	published := srv.waitPublished(3)
+	_ = pool.Close()
+	var routes []string
+	for _, p := range published {
+		routes = append(routes, p.Route)
+	}
+	if strings.Join(routes, ",") != "unroutable,unroutable,ok" {
+		t.Fatalf("published routes = %q", routes)
+	}
+
+	quarantine, err := os.ReadFile(filepath.Join(dir, "quarantine"))
+	if err != nil || !bytes.Contains(quarantine, []byte("poison")) || bytes.Contains(quarantine, []byte("good")) {
+		t.Fatalf("quarantine file: %q %v", quarantine, err)
+	}
+	store, err = rabbitmqpool.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Len() != 0 {
+		t.Fatalf("store len = %d, want 0", store.Len())
+	}
+}
+
+func TestSpoolHeaders(t *testing.T) {
+	srv := newFakeServer(t)
+	dir := filepath.Join(t.TempDir(), "spool")
+	headers := amqp.Table{
+		"int32":   int32(7),
+		"int64":   int64(1) << 40,
+		"float32": float32(1.5),
+		"bytes":   []byte{0, 1, 2},
+		"time":    time.Unix(1700000000, 0).UTC(),
+		"decimal": amqp.Decimal{Scale: 2, Value: 314},
+		"bool":    true,
+		"nil":     nil,
+		"array":   []interface{}{int16(1), "a"},
+		"nested":  amqp.Table{"level": int8(2), "trace": []byte("id")},
+	}
+	data := rabbitmqpool.GetRabbitMqDataFormat("replay", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "replay", "ok", "headers", "")
+	data.Headers = headers
+	store, err := rabbitmqpool.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Append(&rabbitmqpool.SpoolRecord{Message: data, Reason: "test", Attempts: 1}); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	store, err = rabbitmqpool.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := iterateAll(t, store, -1)
+	_ = store.Close()
+	if len(records) != 1 || !reflect.DeepEqual(records[0].Message.Headers, headers) {
+		t.Fatalf("headers after round trip: %#v", records)
+	}
+
+	//重发时按原类型发送
+	pool, err := rabbitmqpool.InitPool(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithSpoolDir(dir),
+		rabbitmqpool.WithReplayInterval(50*time.Millisecond),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := srv.waitPublished(1)
+	_ = pool.Close()
+	if len(published) != 1 {
+		t.Fatalf("published = %d, want 1", len(published))
+	}
+	types := fieldTypes(published[0].Headers)
+	want := map[string]byte{
+		"int32": 'I', "int64": 'l', "float32": 'f', "bytes": 'x', "time": 'T', "decimal": 'D',
+		"bool": 't', "nil": 'V', "array": 'A', "nested": 'F', "nested.level": 'b', "nested.trace": 'x',
+	}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("published header types = %q, want %q", types, want)
+	}
+}
+
+func TestSpoolLegacyHeaders(t *testing.T) {
+	legacy := filepath.Join(t.TempDir(), "localdata.txt")
+	line := `{"message":{"ExchangeName":"replay","Route":"ok","Data":"old","Headers":{"count":3,"ratio":0.5,"nested":{"n":1}}},"reason":"test"}`
+	if err := os.WriteFile(legacy, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := rabbitmqpool.NewFileStore(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	records := iterateAll(t, store, -1)
+	want := amqp.Table{"count": int64(3), "ratio": 0.5, "nested": amqp.Table{"n": int64(1)}}
+	if len(records) != 1 || !reflect.DeepEqual(records[0].Message.Headers, want) {
+		t.Fatalf("legacy headers: %#v", records)
+	}
+	if err = records[0].Message.Headers.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+不支持隔离的自定义存储
+*/
+type plainStore struct {
+	rabbitmqpool.FailoverStore
+}
+
+func TestReplayPoisonRecordPlainStore(t *testing.T) {
+	for _, discard := range []bool{false, true} {
+		srv := newFakeServer(t)
+		srv.onRoute("unroutable", fakeReturn)
+		store := rabbitmqpool.NewMemoryStore(0)
+		poison := rabbitmqpool.GetRabbitMqDataFormat("replay", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "replay", "unroutable", "poison", "")
+		poison.Mandatory = true
+		good := rabbitmqpool.GetRabbitMqDataFormat("replay", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "replay", "ok", "good", "")
+		for _, data := range []*rabbitmqpool.RabbitMqData{poison, good} {
+			if err := store.Append(&rabbitmqpool.SpoolRecord{Message: data, Reason: "test", Attempts: 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pool, err := rabbitmqpool.InitPool(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+			rabbitmqpool.WithMaxConnection(1),
+			rabbitmqpool.WithFailoverStore(plainStore{store}),
+			rabbitmqpool.WithReplayInterval(50*time.Millisecond),
+			rabbitmqpool.WithReplayMaxAttempts(2),
+			rabbitmqpool.WithReplayDiscard(discard),
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 4
+		if discard {
+			want = 3
+		}
+		var routes []string
+		for _, p := range srv.waitPublished(want) {
+			routes = append(routes, p.Route)
+		}
+		_ = pool.Close()
+		if discard {
+			//丢弃第一条记录后继续重发之后的记录
+			if strings.Join(routes, ",") != "unroutable,unroutable,ok" || store.Len() != 0 {
+				t.Fatalf("discard: published routes = %q, store len = %d", routes, store.Len())
+			}
+			continue
+		}
+		//默认保留记录,不丢失数据
+		if strings.Join(routes[:4], ",") != "unroutable,unroutable,unroutable,unroutable" || store.Len() != 2 {
+			t.Fatalf("keep: published routes = %q, store len = %d", routes, store.Len())
+		}
+	}
+}
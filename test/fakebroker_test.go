@@ -0,0 +1,698 @@
+package test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+只完成握手第一步的模拟服务端,返回客户端发送的connection.start-ok
+*/
+func fakeBroker(t *testing.T, mechanisms string) (int, <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFakeBroker(t, listener, mechanisms)
+}
+
+func fakeTLSBroker(t *testing.T, config *tls.Config, mechanisms string) (int, <-chan []byte) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFakeBroker(t, listener, mechanisms)
+}
+
+func serveFakeBroker(t *testing.T, listener net.Listener, mechanisms string) (int, <-chan []byte) {
+	t.Cleanup(func() { listener.Close() })
+	startOk := make(chan []byte, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				header := make([]byte, 8)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				if _, err := conn.Write(connectionStartFrame(mechanisms)); err != nil {
+					return
+				}
+				frameHeader := make([]byte, 7)
+				if _, err := io.ReadFull(conn, frameHeader); err != nil {
+					return
+				}
+				payload := make([]byte, binary.BigEndian.Uint32(frameHeader[3:])+1)
+				if _, err := io.ReadFull(conn, payload); err != nil {
+					return
+				}
+				startOk <- payload
+			}(conn)
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, startOk
+}
+
+func connectionStartFrame(mechanisms string) []byte {
+	var payload bytes.Buffer
+	_ = binary.Write(&payload, binary.BigEndian, uint16(10)) //connection
+	_ = binary.Write(&payload, binary.BigEndian, uint16(10)) //start
+	payload.Write([]byte{0, 9})
+	_ = binary.Write(&payload, binary.BigEndian, uint32(0)) //server-properties
+	for _, s := range []string{mechanisms, "en_US"} {
+		_ = binary.Write(&payload, binary.BigEndian, uint32(len(s)))
+		payload.WriteString(s)
+	}
+	var frame bytes.Buffer
+	frame.WriteByte(1)
+	_ = binary.Write(&frame, binary.BigEndian, uint16(0))
+	_ = binary.Write(&frame, binary.BigEndian, uint32(payload.Len()))
+	frame.Write(payload.Bytes())
+	frame.WriteByte(0xCE)
+	return frame.Bytes()
+}
+
+/*
+模拟服务端对发布消息的处理,按路由设置
+*/
+const (
+	fakeAck       = iota //confirm模式下ack
+	fakeNack             //confirm模式下nack
+	fakeNoConfirm        //不发送确认
+	fakeReturn           //mandatory消息先退回再ack
+)
+
+/*
+模拟服务端收到的消息
+*/
+type fakePublish struct {
+	Exchange    string
+	Route       string
+	Mandatory   bool
+	Confirm     bool //发布时信道处于confirm模式
+	ContentType string
+	MessageId   string
+	Headers     []byte //原始headers表
+	Body        []byte
+}
+
+/*
+模拟服务端投递给消费者的消息,Headers只支持string和int32
+*/
+type fakeDelivery struct {
+	ContentType string
+	Headers     map[string]interface{}
+	Body        []byte
+	Redelivered bool //是否为重新投递的消息
+}
+
+/*
+消费者对投递消息的确认
+*/
+type fakeSettle struct {
+	Method  string //ack/nack/reject
+	Requeue bool
+}
+
+/*
+支持握手、声明、发布确认、退回及投递的模拟服务端
+*/
+type fakeServer struct {
+	t        *testing.T
+	listener net.Listener
+	port     int
+
+	lock      sync.Mutex
+	routes    map[string]int
+	queues    map[string][]fakeDelivery
+	published []fakePublish
+	startOks  [][]byte
+	vhosts    []string
+	heartbeat []uint16 //tune-ok中客户端的心跳间隔(秒)
+	conns     map[net.Conn]struct{}
+	settles   chan fakeSettle
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{
+		t:        t,
+		listener: listener,
+		port:     listener.Addr().(*net.TCPAddr).Port,
+		routes:   make(map[string]int),
+		queues:   make(map[string][]fakeDelivery),
+		conns:    make(map[net.Conn]struct{}),
+		settles:  make(chan fakeSettle, 64),
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		s.dropConnections()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.conns[conn] = struct{}{}
+			s.lock.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+/*
+设置发往route的消息的处理方式
+*/
+func (s *fakeServer) onRoute(route string, action int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.routes[route] = action
+}
+
+/*
+消费者订阅queue时投递的消息
+*/
+func (s *fakeServer) enqueue(queue string, d fakeDelivery) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queues[queue] = append(s.queues[queue], d)
+}
+
+/*
+断开所有连接
+*/
+func (s *fakeServer) dropConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+func (s *fakeServer) connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.conns)
+}
+
+/*
+等待服务端收到n条消息
+*/
+func (s *fakeServer) waitPublished(n int) []fakePublish {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.lock.Lock()
+		published := append([]fakePublish(nil), s.published...)
+		s.lock.Unlock()
+		if len(published) >= n {
+			return published
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("received %d messages, want %d", len(published), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *fakeServer) waitSettle() fakeSettle {
+	select {
+	case settle := <-s.settles:
+		return settle
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("no ack/nack received")
+	}
+	return fakeSettle{}
+}
+
+func (s *fakeServer) startOkPayloads() [][]byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([][]byte(nil), s.startOks...)
+}
+
+func (s *fakeServer) openedVhosts() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.vhosts...)
+}
+
+func (s *fakeServer) heartbeats() []uint16 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]uint16(nil), s.heartbeat...)
+}
+
+/*
+单个连接的状态
+*/
+type fakeConn struct {
+	conn      net.Conn
+	confirms  map[uint16]uint64 //confirm模式信道 -> 最后一条消息的delivery-tag
+	delivered map[uint16]uint64 //信道 -> 最后投递的delivery-tag
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+	}()
+	c := &fakeConn{conn: conn, confirms: make(map[uint16]uint64), delivered: make(map[uint16]uint64)}
+	if !s.handshake(c) {
+		return
+	}
+	for {
+		typ, channel, payload, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case 8:
+			if writeFrame(conn, 8, 0, nil) != nil {
+				return
+			}
+			continue
+		case 1:
+		default:
+			continue
+		}
+		r := &frameReader{b: payload}
+		class, method := r.short(), r.short()
+		if !s.method(c, channel, class, method, r) {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) handshake(c *fakeConn) bool {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return false
+	}
+	if _, err := c.conn.Write(connectionStartFrame("PLAIN AMQPLAIN")); err != nil {
+		return false
+	}
+	_, _, startOk, err := readFrame(c.conn)
+	if err != nil {
+		return false
+	}
+	s.lock.Lock()
+	s.startOks = append(s.startOks, startOk)
+	s.lock.Unlock()
+
+	tune := methodWriter(10, 30)
+	tune.short(0)
+	tune.long(131072)
+	tune.short(0)
+	if writeFrame(c.conn, 1, 0, tune.Bytes()) != nil {
+		return false
+	}
+	_, _, tuneOk, err := readFrame(c.conn)
+	if err != nil {
+		return false
+	}
+	r := &frameReader{b: tuneOk[4:]}
+	r.short()
+	r.long()
+	s.lock.Lock()
+	s.heartbeat = append(s.heartbeat, r.short())
+	s.lock.Unlock()
+	_, _, open, err := readFrame(c.conn)
+	if err != nil {
+		return false
+	}
+	r = &frameReader{b: open[4:]}
+	s.lock.Lock()
+	s.vhosts = append(s.vhosts, r.shortstr())
+	s.lock.Unlock()
+	openOk := methodWriter(10, 41)
+	openOk.shortstr("")
+	return writeFrame(c.conn, 1, 0, openOk.Bytes()) == nil
+}
+
+/*
+处理一个方法帧,连接需要关闭时返回false
+*/
+func (s *fakeServer) method(c *fakeConn, channel uint16, class uint16, method uint16, r *frameReader) bool {
+	reply := func(class uint16, method uint16, fn func(w *frameWriter)) bool {
+		w := methodWriter(class, method)
+		if fn != nil {
+			fn(w)
+		}
+		return writeFrame(c.conn, 1, channel, w.Bytes()) == nil
+	}
+	switch {
+	case class == 10 && method == 50: //connection.close
+		reply(10, 51, nil)
+		return false
+	case class == 20 && method == 10: //channel.open
+		return reply(20, 11, func(w *frameWriter) { w.long(0) })
+	case class == 20 && method == 40: //channel.close
+		delete(c.confirms, channel)
+		return reply(20, 41, nil)
+	case class == 40 && method == 10: //exchange.declare
+		r.short()
+		r.shortstr()
+		r.shortstr()
+		if r.octet()&0x10 != 0 {
+			return true
+		}
+		return reply(40, 11, nil)
+	case class == 50 && method == 10: //queue.declare
+		r.short()
+		queue := r.shortstr()
+		if r.octet()&0x10 != 0 {
+			return true
+		}
+		return reply(50, 11, func(w *frameWriter) {
+			w.shortstr(queue)
+			w.long(0)
+			w.long(0)
+		})
+	case class == 50 && method == 20: //queue.bind
+		r.short()
+		r.shortstr()
+		r.shortstr()
+		r.shortstr()
+		if r.octet()&0x01 != 0 {
+			return true
+		}
+		return reply(50, 21, nil)
+	case class == 60 && method == 10: //basic.qos
+		return reply(60, 11, nil)
+	case class == 85 && method == 10: //confirm.select
+		c.confirms[channel] = 0
+		if r.octet()&0x01 != 0 {
+			return true
+		}
+		return reply(85, 11, nil)
+	case class == 60 && method == 20: //basic.consume
+		r.short()
+		queue := r.shortstr()
+		tag := r.shortstr()
+		if r.octet()&0x08 == 0 && !reply(60, 21, func(w *frameWriter) { w.shortstr(tag) }) {
+			return false
+		}
+		return s.deliver(c, channel, queue, tag)
+	case class == 60 && method == 40: //basic.publish
+		return s.publish(c, channel, r)
+	case class == 60 && method == 80: //basic.ack
+		s.settles <- fakeSettle{Method: "ack"}
+	case class == 60 && method == 120: //basic.nack
+		r.longlong()
+		s.settles <- fakeSettle{Method: "nack", Requeue: r.octet()&0x02 != 0}
+	case class == 60 && method == 90: //basic.reject
+		r.longlong()
+		s.settles <- fakeSettle{Method: "reject", Requeue: r.octet()&0x01 != 0}
+	}
+	return true
+}
+
+func (s *fakeServer) publish(c *fakeConn, channel uint16, r *frameReader) bool {
+	r.short()
+	p := fakePublish{Exchange: r.shortstr(), Route: r.shortstr()}
+	p.Mandatory = r.octet()&0x01 != 0
+	_, _, header, err := readFrame(c.conn)
+	if err != nil {
+		return false
+	}
+	hr := &frameReader{b: header[4:]}
+	size := hr.longlong()
+	flags := hr.short()
+	if flags&0x8000 != 0 {
+		p.ContentType = hr.shortstr()
+	}
+	if flags&0x4000 != 0 {
+		hr.shortstr()
+	}
+	if flags&0x2000 != 0 {
+		p.Headers = hr.table()
+	}
+	if flags&0x1000 != 0 {
+		hr.octet()
+	}
+	if flags&0x0800 != 0 {
+		hr.octet()
+	}
+	for _, bit := range []uint16{0x0400, 0x0200, 0x0100} {
+		if flags&bit != 0 {
+			hr.shortstr()
+		}
+	}
+	if flags&0x0080 != 0 {
+		p.MessageId = hr.shortstr()
+	}
+	for uint64(len(p.Body)) < size {
+		_, _, body, err := readFrame(c.conn)
+		if err != nil {
+			return false
+		}
+		p.Body = append(p.Body, body...)
+	}
+	_, p.Confirm = c.confirms[channel]
+	s.lock.Lock()
+	action := s.routes[p.Route]
+	s.published = append(s.published, p)
+	s.lock.Unlock()
+
+	if action == fakeReturn && p.Mandatory {
+		w := methodWriter(60, 50)
+		w.short(312)
+		w.shortstr("NO_ROUTE")
+		w.shortstr(p.Exchange)
+		w.shortstr(p.Route)
+		if writeFrame(c.conn, 1, channel, w.Bytes()) != nil || writeFrame(c.conn, 2, channel, header) != nil {
+			return false
+		}
+		if len(p.Body) > 0 && writeFrame(c.conn, 3, channel, p.Body) != nil {
+			return false
+		}
+	}
+	if !p.Confirm {
+		return true
+	}
+	c.confirms[channel]++
+	var w *frameWriter
+	switch action {
+	case fakeNoConfirm:
+		return true
+	case fakeNack:
+		w = methodWriter(60, 120)
+		w.longlong(c.confirms[channel])
+		w.octet(0)
+	default:
+		w = methodWriter(60, 80)
+		w.longlong(c.confirms[channel])
+		w.octet(0)
+	}
+	return writeFrame(c.conn, 1, channel, w.Bytes()) == nil
+}
+
+/*
+投递queue中等待的消息,每条消息只投递一次
+*/
+func (s *fakeServer) deliver(c *fakeConn, channel uint16, queue string, tag string) bool {
+	s.lock.Lock()
+	deliveries := s.queues[queue]
+	delete(s.queues, queue)
+	s.lock.Unlock()
+	for _, d := range deliveries {
+		c.delivered[channel]++
+		w := methodWriter(60, 60)
+		w.shortstr(tag)
+		w.longlong(c.delivered[channel])
+		if d.Redelivered {
+			w.octet(1)
+		} else {
+			w.octet(0)
+		}
+		w.shortstr("")
+		w.shortstr(queue)
+		header := &frameWriter{}
+		header.short(60)
+		header.short(0)
+		header.longlong(uint64(len(d.Body)))
+		header.short(0x8000 | 0x2000)
+		header.shortstr(d.ContentType)
+		header.table(d.Headers)
+		if writeFrame(c.conn, 1, channel, w.Bytes()) != nil || writeFrame(c.conn, 2, channel, header.Bytes()) != nil {
+			return false
+		}
+		if len(d.Body) > 0 && writeFrame(c.conn, 3, channel, d.Body) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func readFrame(conn net.Conn) (byte, uint16, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return header[0], binary.BigEndian.Uint16(header[1:3]), payload[:len(payload)-1], nil
+}
+
+func writeFrame(conn net.Conn, typ byte, channel uint16, payload []byte) error {
+	var frame bytes.Buffer
+	frame.WriteByte(typ)
+	_ = binary.Write(&frame, binary.BigEndian, channel)
+	_ = binary.Write(&frame, binary.BigEndian, uint32(len(payload)))
+	frame.Write(payload)
+	frame.WriteByte(0xCE)
+	_, err := conn.Write(frame.Bytes())
+	return err
+}
+
+type frameReader struct {
+	b []byte
+}
+
+func (r *frameReader) next(n int) []byte {
+	if n > len(r.b) {
+		n = len(r.b)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *frameReader) octet() byte {
+	if v := r.next(1); len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *frameReader) short() uint16 {
+	if v := r.next(2); len(v) == 2 {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (r *frameReader) long() uint32 {
+	if v := r.next(4); len(v) == 4 {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *frameReader) longlong() uint64 {
+	if v := r.next(8); len(v) == 8 {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (r *frameReader) shortstr() string {
+	return string(r.next(int(r.octet())))
+}
+
+func (r *frameReader) table() []byte {
+	return r.next(int(r.long()))
+}
+
+/*
+解析原始headers表中每个字段的类型标记,嵌套表的字段以"外层.内层"表示
+*/
+func fieldTypes(raw []byte) map[string]byte {
+	types := make(map[string]byte)
+	r := &frameReader{b: raw}
+	for len(r.b) > 0 {
+		key := r.shortstr()
+		typ := r.octet()
+		types[key] = typ
+		switch typ {
+		case 't', 'b', 'B':
+			r.next(1)
+		case 's', 'u':
+			r.next(2)
+		case 'I', 'i', 'f':
+			r.next(4)
+		case 'D':
+			r.next(5)
+		case 'l', 'd', 'T':
+			r.next(8)
+		case 'S', 'x', 'A':
+			r.next(int(r.long()))
+		case 'F':
+			for k, v := range fieldTypes(r.table()) {
+				types[key+"."+k] = v
+			}
+		}
+	}
+	return types
+}
+
+type frameWriter struct {
+	bytes.Buffer
+}
+
+func methodWriter(class uint16, method uint16) *frameWriter {
+	w := &frameWriter{}
+	w.short(class)
+	w.short(method)
+	return w
+}
+
+func (w *frameWriter) octet(v byte) {
+	w.WriteByte(v)
+}
+
+func (w *frameWriter) short(v uint16) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *frameWriter) long(v uint32) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *frameWriter) longlong(v uint64) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *frameWriter) shortstr(v string) {
+	w.WriteByte(byte(len(v)))
+	w.WriteString(v)
+}
+
+func (w *frameWriter) table(v map[string]interface{}) {
+	var t frameWriter
+	for key, value := range v {
+		t.shortstr(key)
+		switch value := value.(type) {
+		case int32:
+			t.WriteByte('I')
+			_ = binary.Write(&t, binary.BigEndian, value)
+		case string:
+			t.WriteByte('S')
+			t.long(uint32(len(value)))
+			t.WriteString(value)
+		}
+	}
+	w.long(uint32(t.Len()))
+	w.Write(t.Bytes())
+}
@@ -0,0 +1,127 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+func TestRateLimit(t *testing.T) {
+	data := rabbitmqpool.GetRabbitMqDataFormat("testChange5", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "textQueue5", "textQueue5", "update", "")
+
+	//连接不可用,消息放入断线缓冲区,只验证限流
+	failFast := rabbitmqpool.NewProductPool()
+	_ = failFast.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", 1, "root", "root",
+		rabbitmqpool.WithOutageBuffer(100, rabbitmqpool.BUFFER_DROP),
+		rabbitmqpool.WithFailoverStore(rabbitmqpool.NewNopStore()),
+		rabbitmqpool.WithRateLimit(1, 2),
+		rabbitmqpool.WithRateLimitMode(rabbitmqpool.LIMIT_FAIL_FAST)))
+	defer failFast.Close()
+	for i := 0; i < 2; i++ {
+		if err := failFast.Push(data); err != nil {
+			t.Fatalf("push %d: %v", i, err)
+		}
+	}
+	if err := failFast.Push(data); err == nil || err.Code != rabbitmqpool.RCODE_RATE_LIMITED_ERROR {
+		t.Fatalf("fail fast: %v", err)
+	}
+	stats := failFast.RateLimitStats()
+	if len(stats) != 1 || stats[0].Key != rabbitmqpool.RATE_LIMIT_GLOBAL_KEY || stats[0].Allowed != 2 || stats[0].Rejected != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	wait := rabbitmqpool.NewProductPool()
+	_ = wait.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", 1, "root", "root",
+		rabbitmqpool.WithOutageBuffer(100, rabbitmqpool.BUFFER_DROP),
+		rabbitmqpool.WithFailoverStore(rabbitmqpool.NewNopStore()),
+		rabbitmqpool.WithExchangeRateLimit("testChange5", "", 10, 1)))
+	defer wait.Close()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := wait.Push(data); err != nil {
+			t.Fatalf("push %d: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("3 pushes at 10/s took %s", elapsed)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := wait.PushWithContext(ctx, data); err == nil || err.Code != rabbitmqpool.RCODE_RATE_LIMITED_ERROR {
+		t.Fatalf("wait with context: %v", err)
+	}
+	other := rabbitmqpool.GetRabbitMqDataFormat("otherChange", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "otherQueue", "", "update", "")
+	if err := wait.PushWithContext(ctx, other); err != nil {
+		t.Fatalf("other exchange limited: %v", err)
+	}
+}
+
+func TestRateLimitReplay(t *testing.T) {
+	srv := newFakeServer(t)
+	store := rabbitmqpool.NewMemoryStore(0)
+	for i := 0; i < 4; i++ {
+		data := rabbitmqpool.GetRabbitMqDataFormat("replay", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "replay", "ok", "replay", "")
+		if err := store.Append(&rabbitmqpool.SpoolRecord{Message: data, Reason: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	pool, err := rabbitmqpool.InitPool(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithFailoverStore(store),
+		rabbitmqpool.WithReplayInterval(50*time.Millisecond),
+		rabbitmqpool.WithRateLimit(10, 1),
+		rabbitmqpool.WithRateLimitMode(rabbitmqpool.LIMIT_FAIL_FAST),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	//重发等待令牌,不因LIMIT_FAIL_FAST失败
+	srv.waitPublished(4)
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("4 replays at 10/s took %s", elapsed)
+	}
+	stats := pool.RateLimitStats()
+	if len(stats) != 1 || stats[0].Allowed != 4 || stats[0].Rejected != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestRateLimitBufferDrain(t *testing.T) {
+	srv := newFakeServer(t)
+	pool, err := rabbitmqpool.InitPool(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithOutageBuffer(10, rabbitmqpool.BUFFER_BLOCK),
+		rabbitmqpool.WithFailoverStore(rabbitmqpool.NewNopStore()),
+		rabbitmqpool.WithRateLimit(10, 1),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	srv.dropConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.IsHealthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("pool still healthy after connections dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		data := rabbitmqpool.GetRabbitMqDataFormat("drain", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "drain", "ok", "drain", "")
+		if err := pool.Push(data); err != nil {
+			t.Fatalf("buffered push %d: %v", i, err)
+		}
+	}
+
+	//连接恢复后缓冲区的消息同样经过限流
+	srv.waitPublished(3)
+	stats := pool.RateLimitStats()
+	if len(stats) != 1 || stats[0].Allowed != 6 {
+		t.Fatalf("stats = %+v, want 6 allowed", stats)
+	}
+}
@@ -0,0 +1,90 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+func TestMandatoryReturn(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.onRoute("unroutable", fakeReturn)
+	pool := rabbitmqpool.NewProductPool()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithFailoverStore(rabbitmqpool.NewNopStore()),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	newData := func(route string, messageId string, mandatory bool) *rabbitmqpool.RabbitMqData {
+		data := rabbitmqpool.GetRabbitMqDataFormat("mandatory", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "mandatory", route, route, "")
+		data.MessageId = messageId
+		data.Mandatory = mandatory
+		return data
+	}
+	if err := pool.Push(newData("unroutable", "", true)); err == nil || err.Code != rabbitmqpool.RCODE_PUSH_RETURN_ERROR {
+		t.Fatalf("returned push: %v", err)
+	}
+	if err := pool.Push(newData("routable", "order-1", true)); err != nil {
+		t.Fatalf("routable mandatory push: %v", err)
+	}
+	//同一交换机/路由的普通消息使用原来的非confirm信道
+	if err := pool.Push(newData("routable", "", false)); err != nil {
+		t.Fatalf("plain push: %v", err)
+	}
+	if err := pool.Push(newData("unroutable", "order-1", true)); err == nil || err.Code != rabbitmqpool.RCODE_PUSH_RETURN_ERROR {
+		t.Fatalf("returned push with message id: %v", err)
+	}
+
+	published := srv.waitPublished(4)
+	if published[0].MessageId == "" || published[1].MessageId != "order-1" {
+		t.Fatalf("message ids = %q %q", published[0].MessageId, published[1].MessageId)
+	}
+	for i, p := range published {
+		if bytes.Contains(p.Headers, []byte("rabbitmqpool")) {
+			t.Errorf("publish %d carries internal header", i)
+		}
+		if p.Confirm != p.Mandatory {
+			t.Errorf("publish %d: mandatory %v on confirm channel %v", i, p.Mandatory, p.Confirm)
+		}
+	}
+}
+
+func TestPushBatchMandatory(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.onRoute("unroutable", fakeReturn)
+	pool := rabbitmqpool.NewProductPool()
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	//相同MessageId的消息按发布顺序关联退回结果
+	var batch []*rabbitmqpool.RabbitMqData
+	for _, route := range []string{"routable", "unroutable", "routable", "unroutable"} {
+		data := rabbitmqpool.GetRabbitMqDataFormat("mandatory", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "mandatory", route, route, "")
+		data.MessageId = "same"
+		data.Mandatory = true
+		batch = append(batch, data)
+	}
+	results := pool.PushBatch(context.Background(), batch)
+	for i, err := range results {
+		returned := err != nil && err.Code == rabbitmqpool.RCODE_PUSH_RETURN_ERROR
+		if returned != (batch[i].Route == "unroutable") {
+			t.Errorf("result %d for %s: %v", i, batch[i].Route, err)
+		}
+	}
+
+	if err := pool.Push(rabbitmqpool.GetRabbitMqDataFormat("mandatory", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "mandatory", "routable", "plain", "")); err != nil {
+		t.Fatal(err)
+	}
+	if p := srv.waitPublished(5)[4]; p.Confirm {
+		t.Fatal("batch switched the shared channel to confirm mode")
+	}
+}
@@ -0,0 +1,82 @@
+package test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"testing"
+
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+func TestSASLExternal(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "test-ca", nil, true)
+	server := newTestCert(t, "rabbit.local", ca, false)
+	client := newTestCert(t, "client", ca, false)
+	caFile, _ := ca.writePEM(t, dir, "ca")
+	certFile, keyFile := client.writePEM(t, dir, "client")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	port, startOk := fakeTLSBroker(t, &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCert},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, "PLAIN AMQPLAIN EXTERNAL")
+
+	pool := rabbitmqpool.NewProductPool()
+	defer pool.Close()
+	_ = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", port, "", "",
+		rabbitmqpool.WithTLSCA(caFile),
+		rabbitmqpool.WithTLSClientCert(certFile, keyFile),
+		rabbitmqpool.WithTLSServerName("rabbit.local"),
+		rabbitmqpool.WithAuthMechanism(rabbitmqpool.AUTH_EXTERNAL, rabbitmqpool.AUTH_PLAIN),
+	))
+	if payload := receiveStartOk(t, startOk); !bytes.Contains(payload, []byte("EXTERNAL")) {
+		t.Fatal("EXTERNAL mechanism not selected")
+	}
+
+	uri := fmt.Sprintf("amqps://127.0.0.1:%d/?cacertfile=%s&certfile=%s&keyfile=%s&server_name_indication=rabbit.local&auth_mechanism=external", port, caFile, certFile, keyFile)
+	conf, err := rabbitmqpool.NewAmqpConfFromURI(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = pool.Connect(conf)
+	if payload := receiveStartOk(t, startOk); !bytes.Contains(payload, []byte("EXTERNAL")) {
+		t.Fatal("EXTERNAL mechanism from uri not selected")
+	}
+}
+
+func TestSASLMechanisms(t *testing.T) {
+	port, startOk := fakeBroker(t, "AMQPLAIN")
+	pool := rabbitmqpool.NewProductPool()
+	defer pool.Close()
+	_ = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", port, "root", "root",
+		rabbitmqpool.WithAuthMechanism(rabbitmqpool.AUTH_PLAIN, rabbitmqpool.AUTH_AMQPLAIN),
+	))
+	if payload := receiveStartOk(t, startOk); !bytes.Contains(payload, []byte("AMQPLAIN")) {
+		t.Fatal("AMQPLAIN fallback not selected")
+	}
+
+	//EXTERNAL需要amqps及客户端证书
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", port, "", "",
+		rabbitmqpool.WithAuthMechanism(rabbitmqpool.AUTH_EXTERNAL))); err == nil {
+		t.Fatal("EXTERNAL without tls accepted")
+	}
+	if err := pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", port, "", "",
+		rabbitmqpool.WithTLS(nil), rabbitmqpool.WithAuthMechanism(rabbitmqpool.AUTH_EXTERNAL))); err == nil {
+		t.Fatal("EXTERNAL without client certificate accepted")
+	}
+	if _, err := rabbitmqpool.NewAmqpConfFromURI("amqp://127.0.0.1/?auth_mechanism=kerberos"); err == nil {
+		t.Fatal("unknown auth_mechanism accepted")
+	}
+	c := &rabbitmqpool.RabbitConfig{Host: "h", AuthMechanism: []string{"external"}}
+	if err := c.Validate(); err == nil {
+		t.Fatal("external without tls.cert_file accepted")
+	}
+	c.TLS = rabbitmqpool.RabbitTLSConfig{CertFile: "client.pem", KeyFile: "client.key"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,185 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sunerpy/rabbitmqpool"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	tlsCert tls.Certificate
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, tlsCert: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+func (c *testCert) writePEM(t *testing.T, dir string, name string) (string, string) {
+	t.Helper()
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+/*
+本地TLS监听代替broker,只完成握手并记录客户端信息
+*/
+func TestTLSConnect(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "test-ca", nil, true)
+	server := newTestCert(t, "rabbit.local", ca, false)
+	client := newTestCert(t, "client", ca, false)
+	caFile, _ := ca.writePEM(t, dir, "ca")
+	certFile, keyFile := client.writePEM(t, dir, "client")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCert},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	states := make(chan tls.ConnectionState, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err = tlsConn.Handshake(); err == nil {
+			states <- tlsConn.ConnectionState()
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	pool := rabbitmqpool.NewProductPool()
+	defer pool.Close()
+	_ = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", port, "root", "root",
+		rabbitmqpool.WithTLSCA(caFile),
+		rabbitmqpool.WithTLSClientCert(certFile, keyFile),
+		rabbitmqpool.WithTLSServerName("rabbit.local"),
+		rabbitmqpool.WithTLSMinVersion(tls.VersionTLS13)))
+	select {
+	case state := <-states:
+		if state.ServerName != "rabbit.local" || state.Version != tls.VersionTLS13 ||
+			len(state.PeerCertificates) == 0 || state.PeerCertificates[0].Subject.CommonName != "client" {
+			t.Fatalf("unexpected handshake: %+v", state)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tls handshake not completed")
+	}
+
+	if err = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", port, "root", "root",
+		rabbitmqpool.WithTLSCA(filepath.Join(dir, "missing.crt")))); err == nil {
+		t.Fatal("missing CA file accepted")
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, true)
+	server := newTestCert(t, "rabbit.local", ca, false)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	//服务端最高只支持TLS1.2
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCert},
+		MaxVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	handshakes := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			handshakes <- conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	//Connect在握手失败或握手后协议失败时返回,返回服务端的握手结果
+	handshake := func() error {
+		select {
+		case err := <-handshakes:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("no tls handshake")
+		}
+		return nil
+	}
+	base := func(minVersion uint16) *tls.Config {
+		return &tls.Config{RootCAs: roots, ServerName: "rabbit.local", MinVersion: minVersion}
+	}
+	pool := rabbitmqpool.NewProductPool()
+	defer pool.Close()
+
+	//WithTLS配置中的MinVersion不被默认值覆盖
+	_ = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", port, "root", "root", rabbitmqpool.WithTLS(base(tls.VersionTLS13))))
+	if err = handshake(); err == nil {
+		t.Fatal("MinVersion TLS1.3 from WithTLS downgraded to TLS1.2")
+	}
+	//WithTLSMinVersion覆盖WithTLS中的设置
+	_ = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", port, "root", "root",
+		rabbitmqpool.WithTLS(base(tls.VersionTLS13)), rabbitmqpool.WithTLSMinVersion(tls.VersionTLS12)))
+	if err = handshake(); err != nil {
+		t.Fatalf("WithTLSMinVersion TLS1.2: %v", err)
+	}
+	_ = pool.Connect(rabbitmqpool.NewAmqpConf("127.0.0.1", port, "root", "root", rabbitmqpool.WithTLS(base(0))))
+	if err = handshake(); err != nil {
+		t.Fatalf("default min version: %v", err)
+	}
+}
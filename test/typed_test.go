@@ -0,0 +1,97 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sunerpy/rabbitmqpool"
+	"go.uber.org/zap"
+)
+
+func TestTypedPublisherConsumer(t *testing.T) {
+	srv := newFakeServer(t)
+	producer, err := rabbitmqpool.InitPool(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithFailoverStore(rabbitmqpool.NewNopStore()),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := rabbitmqpool.NewPublisher[user](producer, "typed", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "typed", "typed")
+	data, err := publisher.Data(user{Name: "tom", Age: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.ExchangeName != "typed" || data.Route != "typed" || data.ContentType != rabbitmqpool.CONTENT_TYPE_JSON {
+		t.Fatalf("unexpected data: %+v", data)
+	}
+	if e := publisher.Push(user{Name: "tom", Age: 3}); e != nil {
+		t.Fatal(e)
+	}
+	published := srv.waitPublished(1)[0]
+	_ = producer.Close()
+	if published.ContentType != rabbitmqpool.CONTENT_TYPE_JSON {
+		t.Fatalf("published content-type = %q", published.ContentType)
+	}
+
+	//服务端收到的消息原样投递给消费者,按content-type解码
+	srv.enqueue("typed", fakeDelivery{ContentType: published.ContentType, Body: published.Body})
+	srv.enqueue("typed", fakeDelivery{ContentType: "application/json; charset=utf-8", Body: []byte(`{"name":"jerry","age":4}`)})
+	srv.enqueue("typed", fakeDelivery{ContentType: rabbitmqpool.CONTENT_TYPE_JSON, Body: []byte(`{"name":`)})
+	consumerPool, err := rabbitmqpool.InitPool(rabbitmqpool.NewAmqpConf("127.0.0.1", srv.port, "guest", "guest",
+		rabbitmqpool.WithRabbitType(rabbitmqpool.RABBITMQ_TYPE_CONSUME),
+		rabbitmqpool.WithMaxConnection(1),
+		rabbitmqpool.WithMaxConsumeChannel(1),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan user, 2)
+	contentTypes := make(chan string, 2)
+	fails := make(chan int, 1)
+	consumer := rabbitmqpool.NewConsumer[user]("typed", rabbitmqpool.EXCHANGE_TYPE_DIRECT, "typed", "typed",
+		func(v user, delivery *amqp.Delivery, retryClient rabbitmqpool.RetryClientInterface, sLogger *zap.SugaredLogger) bool {
+			got <- v
+			contentTypes <- delivery.ContentType
+			_ = retryClient.Ack()
+			return true
+		})
+	consumer.EventFail = func(code int, e error, data []byte) {
+		fails <- code
+	}
+	consumer.Register(consumerPool)
+	go func() {
+		_ = consumerPool.RunConsume()
+	}()
+	defer consumerPool.Close()
+
+	for _, want := range []user{{Name: "tom", Age: 3}, {Name: "jerry", Age: 4}} {
+		select {
+		case v := <-got:
+			if v != want {
+				t.Fatalf("handler got %+v, want %+v", v, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler not called")
+		}
+		if settle := srv.waitSettle(); settle.Method != "ack" {
+			t.Fatalf("settle = %+v, want ack", settle)
+		}
+	}
+	if ct := <-contentTypes; ct != rabbitmqpool.CONTENT_TYPE_JSON {
+		t.Fatalf("delivery content-type = %q", ct)
+	}
+	//无法解析的json不回调Handler
+	if code := <-fails; code != rabbitmqpool.RCODE_DECODE_ERROR {
+		t.Fatalf("fail code = %d", code)
+	}
+	if settle := srv.waitSettle(); settle.Method != "nack" || !settle.Requeue {
+		t.Fatalf("settle = %+v, want nack requeue", settle)
+	}
+	select {
+	case v := <-got:
+		t.Fatalf("handler called with %+v for invalid json", v)
+	default:
+	}
+}